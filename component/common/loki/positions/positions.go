@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -16,6 +17,7 @@ import (
 
 	"github.com/go-kit/log"
 	"github.com/grafana/agent/pkg/flow/logging/level"
+	"github.com/prometheus/client_golang/prometheus"
 	yaml "gopkg.in/yaml.v2"
 )
 
@@ -23,6 +25,10 @@ const (
 	positionFileMode = 0600
 	cursorKeyPrefix  = "cursor-"
 	journalKeyPrefix = "journal-"
+
+	// defaultMaxSizeStaleAfter is how long an entry must not have been
+	// updated for to be dropped if Config.MaxSizeStaleAfter is unset.
+	defaultMaxSizeStaleAfter = time.Hour
 )
 
 // Config describes where to get position information from.
@@ -31,6 +37,36 @@ type Config struct {
 	PositionsFile     string        `mapstructure:"filename" yaml:"filename"`
 	IgnoreInvalidYaml bool          `mapstructure:"ignore_invalid_yaml" yaml:"ignore_invalid_yaml"`
 	ReadOnly          bool          `mapstructure:"-" yaml:"-"`
+
+	// MaxSize is the maximum size in bytes of the positions file. When the
+	// file would grow past it, entries of log files which no longer exist are
+	// removed first; if that isn't enough, the least recently updated stale
+	// entries are dropped. Zero disables the limit. It's only available to
+	// library users; no component sets it.
+	MaxSize int64 `mapstructure:"-" yaml:"-"`
+	// MaxSizeStaleAfter is how long an entry must not have been updated for
+	// before it may be dropped to stay within MaxSize. Entries updated more
+	// recently are never dropped, even if the positions file stays larger than
+	// MaxSize. Defaults to 1h if zero or less.
+	MaxSizeStaleAfter time.Duration `mapstructure:"-" yaml:"-"`
+
+	// CleanupBatchSize, if positive, removes the entries of log files which
+	// no longer exist incrementally: every CleanupInterval, at most
+	// CleanupBatchSize entries are checked, continuing where the previous
+	// batch stopped. Otherwise, all entries are checked every SyncPeriod.
+	CleanupBatchSize int `mapstructure:"-" yaml:"-"`
+	// CleanupInterval is how often a batch of entries is checked if
+	// CleanupBatchSize is positive. Defaults to SyncPeriod if zero or less.
+	CleanupInterval time.Duration `mapstructure:"-" yaml:"-"`
+
+	// Registerer, if non-nil, is used to register the positions metrics. Like
+	// MaxSize, it's only available to library users.
+	Registerer prometheus.Registerer `mapstructure:"-" yaml:"-"`
+
+	// OnSave, if non-nil, is called with the positions written to the
+	// positions file every time it was written successfully. It must not call
+	// into the Positions.
+	OnSave func(positions map[Entry]string) `mapstructure:"-" yaml:"-"`
 }
 
 // RegisterFlagsWithPrefix registers flags where every name is prefixed by
@@ -50,10 +86,42 @@ func (cfg *Config) RegisterFlags(flags *flag.FlagSet) {
 type positions struct {
 	logger    log.Logger
 	cfg       Config
+	metrics   *metrics
 	mtx       sync.Mutex
+	saveMtx   sync.Mutex // serializes writing the positions file
 	positions map[Entry]string
+	updated   map[Entry]time.Time
+	pending   []Entry // entries left to check by the incremental cleanup
 	quit      chan struct{}
 	done      chan struct{}
+	syncReq   chan struct{}
+}
+
+type metrics struct {
+	sizeLimitExceeded prometheus.Counter
+	droppedEntries    prometheus.Counter
+}
+
+func newMetrics(reg prometheus.Registerer) *metrics {
+	var m metrics
+
+	m.sizeLimitExceeded = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "loki_positions_size_limit_exceeded_total",
+		Help: "Total number of times the positions file exceeded its maximum size",
+	})
+	m.droppedEntries = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "loki_positions_dropped_entries_total",
+		Help: "Total number of positions entries dropped to keep the positions file within its maximum size",
+	})
+
+	if reg != nil {
+		reg.MustRegister(
+			m.sizeLimitExceeded,
+			m.droppedEntries,
+		)
+	}
+
+	return &m
 }
 
 // Entry describes a positions file entry consisting of an absolute file path and
@@ -96,6 +164,16 @@ type Positions interface {
 	Stop()
 }
 
+// Syncer is implemented by Positions which can be written to the positions
+// file on demand, in addition to every SyncPeriod.
+type Syncer interface {
+	// Sync writes the positions file.
+	Sync()
+	// RequestSync writes the positions file in the background, without
+	// waiting for it. Requests made while one is pending are merged.
+	RequestSync()
+}
+
 // New makes a new Positions.
 func New(logger log.Logger, cfg Config) (Positions, error) {
 	positionData, err := readPositionsFile(cfg, logger)
@@ -106,9 +184,20 @@ func New(logger log.Logger, cfg Config) (Positions, error) {
 	p := &positions{
 		logger:    logger,
 		cfg:       cfg,
+		metrics:   newMetrics(cfg.Registerer),
 		positions: positionData,
+		updated:   make(map[Entry]time.Time, len(positionData)),
 		quit:      make(chan struct{}),
 		done:      make(chan struct{}),
+		syncReq:   make(chan struct{}, 1),
+	}
+
+	// Entries loaded from the positions file count as updated now, so that
+	// they aren't dropped to stay within MaxSize before their readers had a
+	// chance to update them after a restart.
+	loaded := time.Now()
+	for e := range positionData {
+		p.updated[e] = loaded
 	}
 
 	go p.run()
@@ -124,6 +213,7 @@ func (p *positions) PutString(path, labels string, pos string) {
 	p.mtx.Lock()
 	defer p.mtx.Unlock()
 	p.positions[Entry{path, labels}] = pos
+	p.updated[Entry{path, labels}] = time.Now()
 }
 
 func (p *positions) Put(path, labels string, pos int64) {
@@ -154,6 +244,7 @@ func (p *positions) Remove(path, labels string) {
 
 func (p *positions) remove(path, labels string) {
 	delete(p.positions, Entry{path, labels})
+	delete(p.updated, Entry{path, labels})
 }
 
 func (p *positions) SyncPeriod() time.Duration {
@@ -168,30 +259,80 @@ func (p *positions) run() {
 	}()
 
 	ticker := time.NewTicker(p.cfg.SyncPeriod)
+	defer ticker.Stop()
+
+	// With an incremental cleanup, entries are checked in batches on their
+	// own schedule rather than all at once on every sync.
+	var cleanup <-chan time.Time
+	if p.cfg.CleanupBatchSize > 0 {
+		interval := p.cfg.CleanupInterval
+		if interval <= 0 {
+			interval = p.cfg.SyncPeriod
+		}
+		cleanupTicker := time.NewTicker(interval)
+		defer cleanupTicker.Stop()
+		cleanup = cleanupTicker.C
+	}
+
 	for {
 		select {
 		case <-p.quit:
 			return
 		case <-ticker.C:
 			p.save()
-			p.cleanup()
+			if p.cfg.CleanupBatchSize <= 0 {
+				p.cleanup()
+			}
+		case <-cleanup:
+			p.cleanupBatch()
+		case <-p.syncReq:
+			p.save()
 		}
 	}
 }
 
+// Sync implements Syncer.
+func (p *positions) Sync() {
+	p.save()
+}
+
+// RequestSync implements Syncer.
+func (p *positions) RequestSync() {
+	select {
+	case p.syncReq <- struct{}{}:
+	default:
+	}
+}
+
 func (p *positions) save() {
 	if p.cfg.ReadOnly {
 		return
 	}
+	p.saveMtx.Lock()
+	defer p.saveMtx.Unlock()
 	p.mtx.Lock()
 	positions := make(map[Entry]string, len(p.positions))
 	for k, v := range p.positions {
 		positions[k] = v
 	}
+	var updated map[Entry]time.Time
+	if p.cfg.MaxSize > 0 {
+		updated = make(map[Entry]time.Time, len(p.updated))
+		for k, v := range p.updated {
+			updated[k] = v
+		}
+	}
 	p.mtx.Unlock()
 
+	if p.cfg.MaxSize > 0 {
+		p.enforceMaxSize(positions, updated)
+	}
 	if err := writePositionFile(p.cfg.PositionsFile, positions); err != nil {
 		level.Error(p.logger).Log("msg", "error writing positions file", "error", err)
+		return
+	}
+	if p.cfg.OnSave != nil {
+		p.cfg.OnSave(positions)
 	}
 }
 
@@ -200,27 +341,171 @@ func CursorKey(key string) string {
 	return fmt.Sprintf("%s%s", cursorKeyPrefix, key)
 }
 
+// enforceMaxSize keeps positions, a snapshot of the positions taken at the
+// time updated was taken, within cfg.MaxSize. Entries of log files which no
+// longer exist are removed first; if that isn't enough, stale entries are
+// dropped, oldest first. Entries are removed from both the snapshot and p,
+// unless they were updated since the snapshot was taken.
+func (p *positions) enforceMaxSize(positions map[Entry]string, updated map[Entry]time.Time) {
+	size := encodedSize(positions)
+	if size <= p.cfg.MaxSize {
+		return
+	}
+	p.metrics.sizeLimitExceeded.Inc()
+	level.Warn(p.logger).Log("msg", "positions file exceeds its maximum size, compacting", "size", size, "max_size", p.cfg.MaxSize)
+
+	var removed []Entry
+	for e := range positions {
+		if !isCursor(e.Path) && isStale(p.logger, e.Path) {
+			removed = append(removed, e)
+		}
+	}
+	for _, e := range removed {
+		size -= entrySize(e, positions[e])
+		delete(positions, e)
+	}
+
+	var dropped int
+	if size > p.cfg.MaxSize {
+		// Only entries which weren't updated for a while are dropped, so that
+		// active readers don't lose their positions. Entries loaded from the
+		// positions file count as updated when they were loaded.
+		staleBefore := time.Now().Add(-p.staleAfter())
+		var candidates []Entry
+		for e := range positions {
+			if updated[e].Before(staleBefore) {
+				candidates = append(candidates, e)
+			}
+		}
+		sort.Slice(candidates, func(i, j int) bool {
+			return updated[candidates[i]].Before(updated[candidates[j]])
+		})
+		for _, e := range candidates {
+			if size <= p.cfg.MaxSize {
+				break
+			}
+			size -= entrySize(e, positions[e])
+			delete(positions, e)
+			removed = append(removed, e)
+			dropped++
+		}
+		p.metrics.droppedEntries.Add(float64(dropped))
+		level.Warn(p.logger).Log("msg", "dropped oldest stale positions entries to stay within the maximum size", "dropped", dropped, "size", size, "max_size", p.cfg.MaxSize)
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	for _, e := range removed {
+		if p.updated[e].Equal(updated[e]) {
+			p.remove(e.Path, e.Labels)
+		}
+	}
+}
+
+func (p *positions) staleAfter() time.Duration {
+	if p.cfg.MaxSizeStaleAfter <= 0 {
+		return defaultMaxSizeStaleAfter
+	}
+	return p.cfg.MaxSizeStaleAfter
+}
+
+// entrySize returns the number of bytes a single entry adds to the encoded
+// positions file.
+func entrySize(e Entry, pos string) int64 {
+	return encodedSize(map[Entry]string{e: pos}) - int64(len("positions:\n"))
+}
+
+// encodedSize returns the size in bytes of positions once written to the
+// positions file.
+func encodedSize(positions map[Entry]string) int64 {
+	buf, err := yaml.Marshal(File{Positions: positions})
+	if err != nil {
+		return 0
+	}
+	return int64(len(buf))
+}
+
 func (p *positions) cleanup() {
 	p.mtx.Lock()
 	defer p.mtx.Unlock()
+	p.removeStale()
+}
+
+// cleanupBatch checks the next cfg.CleanupBatchSize entries and removes the
+// ones of log files which no longer exist. Once all entries were checked, the
+// next batch starts over with the entries present at that time. It returns
+// the number of checked entries.
+func (p *positions) cleanupBatch() int {
+	p.mtx.Lock()
+	if len(p.pending) == 0 {
+		for e := range p.positions {
+			if !isCursor(e.Path) {
+				p.pending = append(p.pending, e)
+			}
+		}
+		sort.Slice(p.pending, func(i, j int) bool {
+			if p.pending[i].Path != p.pending[j].Path {
+				return p.pending[i].Path < p.pending[j].Path
+			}
+			return p.pending[i].Labels < p.pending[j].Labels
+		})
+	}
+	n := min(p.cfg.CleanupBatchSize, len(p.pending))
+	batch := p.pending[:n:n]
+	p.pending = p.pending[n:]
+	p.mtx.Unlock()
+
+	// The files are checked without holding the lock, so that a slow file
+	// system doesn't block updating positions.
+	var toRemove []Entry
+	for _, e := range batch {
+		if isStale(p.logger, e.Path) {
+			toRemove = append(toRemove, e)
+		}
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	for _, e := range toRemove {
+		p.remove(e.Path, e.Labels)
+	}
+	return len(batch)
+}
+
+// isCursor reports whether the path of an entry is a cursor rather than a
+// file on disk.
+func isCursor(path string) bool {
+	// We still have to support journal files, so we keep the previous check to avoid breaking change.
+	return strings.HasPrefix(path, cursorKeyPrefix) || strings.HasPrefix(path, journalKeyPrefix)
+}
+
+// isStale reports whether the log file at path no longer exists.
+func isStale(logger log.Logger, path string) bool {
+	_, err := os.Stat(path)
+	if err == nil {
+		return false
+	}
+	if !os.IsNotExist(err) {
+		// Can't determine if file exists or not, some other error.
+		level.Warn(logger).Log("msg", "could not determine if log file "+
+			"still exists while cleaning positions file", "error", err)
+		return false
+	}
+	return true
+}
+
+// removeStale removes the entries of log files which no longer exist. It must
+// be called with p.mtx held.
+func (p *positions) removeStale() {
 	toRemove := []Entry{}
 	for k := range p.positions {
 		// If the position file is prefixed with cursor, it's a
 		// cursor and not a file on disk.
-		// We still have to support journal files, so we keep the previous check to avoid breaking change.
-		if strings.HasPrefix(k.Path, cursorKeyPrefix) || strings.HasPrefix(k.Path, journalKeyPrefix) {
+		if isCursor(k.Path) {
 			continue
 		}
-
-		if _, err := os.Stat(k.Path); err != nil {
-			if os.IsNotExist(err) {
-				// File no longer exists.
-				toRemove = append(toRemove, k)
-			} else {
-				// Can't determine if file exists or not, some other error.
-				level.Warn(p.logger).Log("msg", "could not determine if log file "+
-					"still exists while cleaning positions file", "error", err)
-			}
+		if isStale(p.logger, k.Path) {
+			toRemove = append(toRemove, k)
 		}
 	}
 	for _, tr := range toRemove {
@@ -5,12 +5,16 @@ package positions
 // same place in case of a restart.
 
 import (
+	"fmt"
 	"os"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/require"
 
 	util_log "github.com/grafana/loki/pkg/util/log"
@@ -199,6 +203,51 @@ positions:
 	}, out)
 }
 
+func TestSync(t *testing.T) {
+	temp := tempFilename(t)
+	defer func() {
+		_ = os.Remove(temp)
+	}()
+	var saved map[Entry]string
+	p, err := New(util_log.Logger, Config{
+		SyncPeriod:    20 * time.Second,
+		PositionsFile: temp,
+		OnSave:        func(positions map[Entry]string) { saved = positions },
+	})
+	require.NoError(t, err)
+	defer p.Stop()
+
+	p.Put("/tmp/random.log", `{job="tmp"}`, 17623)
+	p.(Syncer).Sync()
+	out, err := readPositionsFile(Config{PositionsFile: temp}, log.NewNopLogger())
+	require.NoError(t, err)
+	require.Equal(t, map[Entry]string{
+		{Path: "/tmp/random.log", Labels: `{job="tmp"}`}: "17623",
+	}, out)
+	require.Equal(t, out, saved)
+}
+
+func TestRequestSync(t *testing.T) {
+	temp := tempFilename(t)
+	defer func() {
+		_ = os.Remove(temp)
+	}()
+	p, err := New(util_log.Logger, Config{
+		SyncPeriod:    20 * time.Second,
+		PositionsFile: temp,
+	})
+	require.NoError(t, err)
+	defer p.Stop()
+
+	p.Put("/tmp/random.log", `{job="tmp"}`, 17623)
+	p.(Syncer).RequestSync()
+	p.(Syncer).RequestSync()
+	require.Eventually(t, func() bool {
+		out, err := readPositionsFile(Config{PositionsFile: temp}, log.NewNopLogger())
+		return err == nil && out[Entry{Path: "/tmp/random.log", Labels: `{job="tmp"}`}] == "17623"
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
 func TestWriteEmptyLabels(t *testing.T) {
 	temp := tempFilename(t)
 	defer func() {
@@ -288,3 +337,152 @@ positions:
 		Labels: ``,
 	}])
 }
+
+func TestMaxSize(t *testing.T) {
+	temp := tempFilename(t)
+	defer func() {
+		_ = os.Remove(temp)
+	}()
+
+	p, err := New(util_log.Logger, Config{
+		SyncPeriod:    20 * time.Second,
+		PositionsFile: temp,
+		MaxSize:       256,
+		Registerer:    prometheus.NewRegistry(),
+	})
+	require.NoError(t, err)
+	defer p.Stop()
+
+	// Entries for files which don't exist are compacted away first.
+	p.Put("/tmp/does/not/exist/a.log", "", 1)
+	p.Put("/tmp/does/not/exist/b.log", "", 2)
+	for i := 0; i < 10; i++ {
+		p.Put(CursorKey(fmt.Sprintf("container-%d", i)), `{job="docker"}`, int64(i))
+	}
+	// All but the last entry are stale, the oldest first.
+	pp := p.(*positions)
+	pp.mtx.Lock()
+	for i := 0; i < 9; i++ {
+		pp.updated[Entry{Path: CursorKey(fmt.Sprintf("container-%d", i)), Labels: `{job="docker"}`}] = time.Now().Add(-2*time.Hour + time.Duration(i)*time.Minute)
+	}
+	pp.mtx.Unlock()
+	pp.save()
+
+	fi, err := os.Stat(temp)
+	require.NoError(t, err)
+	require.LessOrEqual(t, fi.Size(), int64(256))
+
+	out, err := readPositionsFile(Config{PositionsFile: temp}, log.NewNopLogger())
+	require.NoError(t, err)
+	require.NotContains(t, out, Entry{Path: "/tmp/does/not/exist/a.log"})
+	// The most recently updated entry is kept.
+	require.Contains(t, out, Entry{Path: CursorKey("container-9"), Labels: `{job="docker"}`})
+	require.NotContains(t, out, Entry{Path: CursorKey("container-0"), Labels: `{job="docker"}`})
+
+	m := pp.metrics
+	require.Equal(t, 1.0, testutil.ToFloat64(m.sizeLimitExceeded))
+	require.Equal(t, float64(10-len(out)), testutil.ToFloat64(m.droppedEntries))
+	require.Equal(t, len(out), len(pp.positions))
+
+	// Entries which were updated recently are kept, even if the positions
+	// file stays larger than its maximum size.
+	for i := 10; i < 20; i++ {
+		p.Put(CursorKey(fmt.Sprintf("container-%d", i)), `{job="docker"}`, int64(i))
+	}
+	pp.save()
+	out, err = readPositionsFile(Config{PositionsFile: temp}, log.NewNopLogger())
+	require.NoError(t, err)
+	for i := 10; i < 20; i++ {
+		require.Contains(t, out, Entry{Path: CursorKey(fmt.Sprintf("container-%d", i)), Labels: `{job="docker"}`})
+	}
+	require.Contains(t, out, Entry{Path: CursorKey("container-9"), Labels: `{job="docker"}`})
+}
+
+func TestMaxSizeLoadedEntries(t *testing.T) {
+	temp := tempFilename(t)
+	defer func() {
+		_ = os.Remove(temp)
+	}()
+
+	loaded := make(map[Entry]string)
+	for i := 0; i < 10; i++ {
+		loaded[Entry{Path: CursorKey(fmt.Sprintf("container-%d", i)), Labels: `{job="docker"}`}] = strconv.Itoa(i)
+	}
+	require.NoError(t, writePositionFile(temp, loaded))
+
+	p, err := New(util_log.Logger, Config{
+		SyncPeriod:    20 * time.Second,
+		PositionsFile: temp,
+		MaxSize:       256,
+		Registerer:    prometheus.NewRegistry(),
+	})
+	require.NoError(t, err)
+	defer p.Stop()
+
+	// Going over the maximum size doesn't drop the loaded entries, as they
+	// count as updated when they were loaded and aren't stale yet.
+	p.Put(CursorKey("container-10"), `{job="docker"}`, 10)
+	pp := p.(*positions)
+	pp.save()
+
+	out, err := readPositionsFile(Config{PositionsFile: temp}, log.NewNopLogger())
+	require.NoError(t, err)
+	require.Len(t, out, 11)
+	for e := range loaded {
+		require.Contains(t, out, e)
+	}
+	require.Zero(t, testutil.ToFloat64(pp.metrics.droppedEntries))
+}
+
+func TestEntrySize(t *testing.T) {
+	positions := map[Entry]string{}
+	var size int64
+	for i := 0; i < 10; i++ {
+		e := Entry{Path: CursorKey(fmt.Sprintf("container-%d", i)), Labels: fmt.Sprintf(`{job="docker",i="%d"}`, i)}
+		positions[e] = strconv.Itoa(i * 1000)
+		size += entrySize(e, positions[e])
+	}
+	require.Equal(t, encodedSize(positions), int64(len("positions:\n"))+size)
+}
+
+func TestCleanupBatches(t *testing.T) {
+	temp := tempFilename(t)
+	defer func() {
+		_ = os.Remove(temp)
+	}()
+
+	p, err := New(util_log.Logger, Config{
+		SyncPeriod:       20 * time.Second,
+		PositionsFile:    temp,
+		CleanupBatchSize: 2,
+		CleanupInterval:  time.Hour,
+	})
+	require.NoError(t, err)
+	defer p.Stop()
+
+	for i := 0; i < 5; i++ {
+		p.Put(fmt.Sprintf("/tmp/does/not/exist/%d.log", i), "", int64(i))
+	}
+	// Cursors aren't files and are neither checked nor removed.
+	p.Put(CursorKey("container"), "", 1)
+
+	pp := p.(*positions)
+	remaining := 5
+	for _, expect := range []int{2, 2, 1} {
+		require.Equal(t, expect, pp.cleanupBatch())
+		remaining -= expect
+		pp.mtx.Lock()
+		require.Len(t, pp.positions, remaining+1)
+		pp.mtx.Unlock()
+	}
+	require.Empty(t, pp.pending)
+	require.Equal(t, "1", p.GetString(CursorKey("container"), ""))
+	for i := 0; i < 5; i++ {
+		require.Empty(t, p.GetString(fmt.Sprintf("/tmp/does/not/exist/%d.log", i), ""))
+	}
+
+	// Entries added later are checked once the next round starts.
+	p.Put("/tmp/does/not/exist/late.log", "", 1)
+	require.Equal(t, 1, pp.cleanupBatch())
+	require.Empty(t, p.GetString("/tmp/does/not/exist/late.log", ""))
+}
@@ -20,28 +20,29 @@ const (
 	StageTypeDocker     = "docker"
 	StageTypeDrop       = "drop"
 	//TODO(thampiotr): Add support for eventlogmessage stage
-	StageTypeEventLogMessage    = "eventlogmessage"
-	StageTypeGeoIP              = "geoip"
-	StageTypeJSON               = "json"
-	StageTypeLabel              = "labels"
-	StageTypeLabelAllow         = "labelallow"
-	StageTypeLabelDrop          = "labeldrop"
-	StageTypeLimit              = "limit"
-	StageTypeLogfmt             = "logfmt"
-	StageTypeMatch              = "match"
-	StageTypeMetric             = "metrics"
-	StageTypeMultiline          = "multiline"
-	StageTypeOutput             = "output"
-	StageTypePack               = "pack"
-	StageTypePipeline           = "pipeline"
-	StageTypeRegex              = "regex"
-	StageTypeReplace            = "replace"
-	StageTypeSampling           = "sampling"
-	StageTypeStaticLabels       = "static_labels"
-	StageTypeStructuredMetadata = "structured_metadata"
-	StageTypeTemplate           = "template"
-	StageTypeTenant             = "tenant"
-	StageTypeTimestamp          = "timestamp"
+	StageTypeEventLogMessage         = "eventlogmessage"
+	StageTypeGeoIP                   = "geoip"
+	StageTypeJSON                    = "json"
+	StageTypeLabel                   = "labels"
+	StageTypeLabelAllow              = "labelallow"
+	StageTypeLabelDrop               = "labeldrop"
+	StageTypeLimit                   = "limit"
+	StageTypeLogfmt                  = "logfmt"
+	StageTypeMatch                   = "match"
+	StageTypeMetric                  = "metrics"
+	StageTypeMultiline               = "multiline"
+	StageTypeOutput                  = "output"
+	StageTypePack                    = "pack"
+	StageTypePipeline                = "pipeline"
+	StageTypeRegex                   = "regex"
+	StageTypeReplace                 = "replace"
+	StageTypeSampling                = "sampling"
+	StageTypeStaticLabels            = "static_labels"
+	StageTypeStructuredMetadata      = "structured_metadata"
+	StageTypeStructuredMetadataRegex = "structured_metadata_regex"
+	StageTypeTemplate                = "template"
+	StageTypeTenant                  = "tenant"
+	StageTypeTimestamp               = "timestamp"
 )
 
 // Processor takes an existing set of labels, timestamp and log entry and returns either a possibly mutated
@@ -151,6 +152,11 @@ func New(logger log.Logger, jobName *string, cfg StageConfig, registerer prometh
 		if err != nil {
 			return nil, err
 		}
+	case cfg.StructuredMetadataRegex != nil:
+		s, err = newStructuredMetadataRegexStage(logger, *cfg.StructuredMetadataRegex)
+		if err != nil {
+			return nil, err
+		}
 	case cfg.RegexConfig != nil:
 		s, err = newRegexStage(logger, *cfg.RegexConfig)
 		if err != nil {
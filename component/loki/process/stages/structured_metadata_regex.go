@@ -0,0 +1,81 @@
+package stages
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/agent/pkg/flow/logging/level"
+	"github.com/grafana/loki/pkg/logproto"
+)
+
+// ErrUnnamedCaptureGroup is returned when the expression of a
+// structured_metadata_regex stage has a capture group without a name.
+var ErrUnnamedCaptureGroup = errors.New("every capture group must be named")
+
+// structuredMetadataRegexStage adds every named capture group of a regular
+// expression matching the log line to the entry's structured metadata.
+// Capture groups which matched an empty string, e.g. optional ones which
+// didn't participate in the match, are skipped.
+type structuredMetadataRegexStage struct {
+	config     RegexConfig
+	expression *regexp.Regexp
+	logger     log.Logger
+}
+
+func newStructuredMetadataRegexStage(logger log.Logger, config RegexConfig) (Stage, error) {
+	expression, err := validateRegexConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	for i, name := range expression.SubexpNames() {
+		if i != 0 && name == "" {
+			return nil, fmt.Errorf("%w: capture group %d of %q", ErrUnnamedCaptureGroup, i, config.Expression)
+		}
+	}
+	return &structuredMetadataRegexStage{
+		config:     config,
+		expression: expression,
+		logger:     log.With(logger, "component", "stage", "type", StageTypeStructuredMetadataRegex),
+	}, nil
+}
+
+// Name implements Stage.
+func (s *structuredMetadataRegexStage) Name() string {
+	return StageTypeStructuredMetadataRegex
+}
+
+// Run implements Stage.
+func (s *structuredMetadataRegexStage) Run(in chan Entry) chan Entry {
+	return RunWith(in, func(e Entry) Entry {
+		input := e.Line
+		if s.config.Source != nil {
+			value, ok := e.Extracted[*s.config.Source]
+			if !ok {
+				level.Debug(s.logger).Log("msg", "source does not exist in the set of extracted values", "source", *s.config.Source)
+				return e
+			}
+			str, err := getString(value)
+			if err != nil {
+				level.Debug(s.logger).Log("msg", "failed to convert source value to string", "source", *s.config.Source, "err", err, "type", reflect.TypeOf(value))
+				return e
+			}
+			input = str
+		}
+
+		match := s.expression.FindStringSubmatch(input)
+		if match == nil {
+			level.Debug(s.logger).Log("msg", "regex did not match", "input", input, "regex", s.expression)
+			return e
+		}
+
+		for i, name := range s.expression.SubexpNames() {
+			if i != 0 && match[i] != "" {
+				e.StructuredMetadata = append(e.StructuredMetadata, logproto.LabelAdapter{Name: name, Value: match[i]})
+			}
+		}
+		return e
+	})
+}
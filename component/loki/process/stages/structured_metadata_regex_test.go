@@ -0,0 +1,82 @@
+package stages
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/loki/pkg/push"
+	util_log "github.com/grafana/loki/pkg/util/log"
+)
+
+var pipelineStagesStructuredMetadataRegex = `
+stage.structured_metadata_regex {
+	expression = "^(?P<ip>\\S+) (?P<method>[A-Z]+) (?P<path>\\S+) (?:\\d+)$"
+}
+`
+
+var pipelineStagesStructuredMetadataRegexWithSource = `
+stage.json {
+	expressions = {msg = ""}
+}
+
+stage.structured_metadata_regex {
+	expression = "user=(?P<user>\\w+)"
+	source     = "msg"
+}
+`
+
+var pipelineStagesStructuredMetadataRegexOptional = `
+stage.structured_metadata_regex {
+	expression = "^(?P<method>[A-Z]+)(?: user=(?P<user>\\w+))?"
+}
+`
+
+func Test_StructuredMetadataRegexStage(t *testing.T) {
+	tests := map[string]struct {
+		pipelineStagesYaml         string
+		logLine                    string
+		expectedStructuredMetadata push.LabelsAdapter
+	}{
+		"expected every named capture group to be added to structured metadata": {
+			pipelineStagesYaml: pipelineStagesStructuredMetadataRegex,
+			logLine:            "10.0.0.1 GET /api/v1/push 204",
+			expectedStructuredMetadata: push.LabelsAdapter{
+				push.LabelAdapter{Name: "ip", Value: "10.0.0.1"},
+				push.LabelAdapter{Name: "method", Value: "GET"},
+				push.LabelAdapter{Name: "path", Value: "/api/v1/push"},
+			},
+		},
+		"expected non-matching lines to be left untouched": {
+			pipelineStagesYaml: pipelineStagesStructuredMetadataRegex,
+			logLine:            "this line does not match",
+		},
+		"expected captures from the source value to be added to structured metadata": {
+			pipelineStagesYaml:         pipelineStagesStructuredMetadataRegexWithSource,
+			logLine:                    `{"msg":"login user=alice"}`,
+			expectedStructuredMetadata: push.LabelsAdapter{push.LabelAdapter{Name: "user", Value: "alice"}},
+		},
+		"expected empty optional captures to be skipped": {
+			pipelineStagesYaml:         pipelineStagesStructuredMetadataRegexOptional,
+			logLine:                    "GET /api/v1/push",
+			expectedStructuredMetadata: push.LabelsAdapter{push.LabelAdapter{Name: "method", Value: "GET"}},
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			pl, err := NewPipeline(util_log.Logger, loadConfig(test.pipelineStagesYaml), nil, prometheus.DefaultRegisterer)
+			require.NoError(t, err)
+
+			result := processEntries(pl, newEntry(nil, nil, test.logLine, time.Now()))[0]
+			require.Equal(t, test.expectedStructuredMetadata, result.StructuredMetadata)
+			require.Equal(t, test.logLine, result.Line)
+		})
+	}
+}
+
+func Test_StructuredMetadataRegexStageUnnamedCaptureGroup(t *testing.T) {
+	_, err := newStructuredMetadataRegexStage(util_log.Logger, RegexConfig{Expression: "^(?P<method>[A-Z]+) (\\S+)"})
+	require.ErrorIs(t, err, ErrUnnamedCaptureGroup)
+}
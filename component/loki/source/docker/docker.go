@@ -27,6 +27,7 @@ import (
 	"github.com/prometheus/common/config"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/model/relabel"
+	"golang.org/x/time/rate"
 )
 
 func init() {
@@ -42,6 +43,13 @@ func init() {
 
 var userAgent = useragent.Get()
 
+// Reconnects of the targets of a component are limited to spread them out,
+// e.g. after the Docker daemon restarted, unless configured otherwise.
+const (
+	defaultReconnectRateLimit = 5
+	defaultReconnectBurst     = 5
+)
+
 const (
 	dockerLabel                = model.MetaLabelPrefix + "docker_"
 	dockerLabelContainerPrefix = dockerLabel + "container_"
@@ -58,14 +66,20 @@ type Arguments struct {
 	RelabelRules     flow_relabel.Rules      `river:"relabel_rules,attr,optional"`
 	HTTPClientConfig *types.HTTPClientConfig `river:"http_client_config,block,optional"`
 	RefreshInterval  time.Duration           `river:"refresh_interval,attr,optional"`
+	UserAgent        string                  `river:"user_agent,attr,optional"`
+
+	ReconnectRateLimit float64 `river:"reconnect_rate_limit,attr,optional"`
+	ReconnectBurst     int     `river:"reconnect_burst,attr,optional"`
 }
 
 // GetDefaultArguments return an instance of Arguments with the optional fields
 // initialized.
 func GetDefaultArguments() Arguments {
 	return Arguments{
-		HTTPClientConfig: types.CloneDefaultHTTPClientConfig(),
-		RefreshInterval:  60 * time.Second,
+		HTTPClientConfig:   types.CloneDefaultHTTPClientConfig(),
+		RefreshInterval:    60 * time.Second,
+		ReconnectRateLimit: defaultReconnectRateLimit,
+		ReconnectBurst:     defaultReconnectBurst,
 	}
 }
 
@@ -79,6 +93,12 @@ func (a *Arguments) Validate() error {
 	if _, err := url.Parse(a.Host); err != nil {
 		return fmt.Errorf("failed to parse Docker host %q: %w", a.Host, err)
 	}
+	if a.ReconnectRateLimit <= 0 {
+		return fmt.Errorf("reconnect_rate_limit must be positive, got %v", a.ReconnectRateLimit)
+	}
+	if a.ReconnectBurst < 1 {
+		return fmt.Errorf("reconnect_burst must be at least 1, got %d", a.ReconnectBurst)
+	}
 	// We must explicitly Validate because HTTPClientConfig is squashed and it won't run otherwise
 	if a.HTTPClientConfig != nil {
 		if a.RefreshInterval <= 0 {
@@ -97,8 +117,9 @@ var (
 
 // Component implements the loki.source.file component.
 type Component struct {
-	opts    component.Options
-	metrics *dt.Metrics
+	opts             component.Options
+	metrics          *dt.Metrics
+	reconnectLimiter *dt.ReconnectLimiter
 
 	mut           sync.RWMutex
 	args          Arguments
@@ -119,19 +140,22 @@ func New(o component.Options, args Arguments) (*Component, error) {
 	if err != nil && !os.IsExist(err) {
 		return nil, err
 	}
+	metrics := dt.NewMetrics(o.Registerer)
 	positionsFile, err := positions.New(o.Logger, positions.Config{
 		SyncPeriod:        10 * time.Second,
 		PositionsFile:     filepath.Join(o.DataPath, "positions.yml"),
 		IgnoreInvalidYaml: false,
 		ReadOnly:          false,
+		OnSave:            metrics.PositionsSaved,
 	})
 	if err != nil {
 		return nil, err
 	}
 
 	c := &Component{
-		opts:    o,
-		metrics: dt.NewMetrics(o.Registerer),
+		opts:             o,
+		metrics:          metrics,
+		reconnectLimiter: dt.NewReconnectLimiter(rate.Limit(args.ReconnectRateLimit), args.ReconnectBurst),
 
 		handler:   loki.NewLogsReceiver(),
 		manager:   newManager(o.Logger, nil),
@@ -212,6 +236,7 @@ func (c *Component) Update(args component.Arguments) error {
 	} else {
 		c.rcs = []*relabel.Config{}
 	}
+	c.reconnectLimiter.SetLimits(rate.Limit(newArgs.ReconnectRateLimit), newArgs.ReconnectBurst)
 
 	// Convert input targets into targets to give to tailer.
 	targets := make([]*dt.Target, 0, len(newArgs.Targets))
@@ -242,6 +267,7 @@ func (c *Component) Update(args component.Arguments) error {
 			labels.Merge(c.defaultLabels),
 			c.rcs,
 			c.manager.opts.client,
+			dt.Options{ReconnectLimiter: c.reconnectLimiter},
 		)
 		if err != nil {
 			return err
@@ -251,18 +277,32 @@ func (c *Component) Update(args component.Arguments) error {
 
 	// This will never fail because it only fails if the context gets canceled.
 	_ = c.manager.syncTargets(context.Background(), targets)
+	// Containers which are gone aren't limited when they come back.
+	c.reconnectLimiter.Retain(seenTargets)
 
 	c.args = newArgs
 	return nil
 }
 
+// PauseAll pauses reading logs from all containers until ResumeAll is called,
+// e.g. during maintenance windows. Positions are kept, so that reading
+// continues where it stopped.
+func (c *Component) PauseAll() {
+	c.manager.pauseAll()
+}
+
+// ResumeAll resumes reading logs from all containers after PauseAll.
+func (c *Component) ResumeAll() {
+	c.manager.resumeAll()
+}
+
 // getTailerOptions gets tailer options from arguments. If args hasn't changed
 // from the last call to getTailerOptions, c.lastOptions is returned.
 // c.lastOptions must be updated by the caller.
 //
 // getTailerOptions must only be called when c.mut is held.
 func (c *Component) getManagerOptions(args Arguments) (*options, error) {
-	if reflect.DeepEqual(c.args.Host, args.Host) && c.lastOptions != nil {
+	if reflect.DeepEqual(c.args.Host, args.Host) && c.args.UserAgent == args.UserAgent && c.lastOptions != nil {
 		return c.lastOptions, nil
 	}
 
@@ -271,9 +311,17 @@ func (c *Component) getManagerOptions(args Arguments) (*options, error) {
 		return c.lastOptions, err
 	}
 
+	ua := args.UserAgent
+	if ua == "" {
+		ua = userAgent
+	}
 	opts := []client.Opt{
 		client.WithHost(args.Host),
 		client.WithAPIVersionNegotiation(),
+		// Custom headers are sent with requests over any protocol.
+		client.WithHTTPHeaders(map[string]string{
+			"User-Agent": ua,
+		}),
 	}
 
 	// There are other protocols than HTTP supported by the Docker daemon, like
@@ -290,9 +338,6 @@ func (c *Component) getManagerOptions(args Arguments) (*options, error) {
 				Timeout:   args.RefreshInterval,
 			}),
 			client.WithScheme(hostURL.Scheme),
-			client.WithHTTPHeaders(map[string]string{
-				"User-Agent": userAgent,
-			}),
 		)
 	}
 
@@ -8,6 +8,10 @@ import (
 	"time"
 
 	"github.com/grafana/agent/component"
+	"github.com/grafana/agent/component/common/loki"
+	"github.com/grafana/agent/component/discovery"
+	dt "github.com/grafana/agent/component/loki/source/docker/internal/dockertarget"
+	"github.com/grafana/agent/component/loki/source/docker/internal/fakedocker"
 	"github.com/grafana/agent/pkg/flow/componenttest"
 	"github.com/grafana/agent/pkg/util"
 	"github.com/grafana/river"
@@ -73,3 +77,179 @@ func TestDuplicateTargets(t *testing.T) {
 
 	require.Len(t, cmp.manager.tasks, 1)
 }
+
+func TestPauseAll(t *testing.T) {
+	d := fakedocker.New(t)
+	d.AddContainer("a", "/a", "2023-12-09T09:16:57.000000000Z a first")
+	d.AddContainer("b", "/b", "2023-12-09T09:16:57.000000000Z b first")
+
+	args := GetDefaultArguments()
+	args.Host = d.URL()
+	args.Targets = []discovery.Target{
+		{dockerLabelContainerID: "a"},
+		{dockerLabelContainerID: "b"},
+	}
+	recv := loki.NewLogsReceiver()
+	args.ForwardTo = []loki.LogsReceiver{recv}
+
+	cmp, err := New(component.Options{
+		ID:         "loki.source.docker.test",
+		Logger:     util.TestFlowLogger(t),
+		Registerer: prometheus.NewRegistry(),
+		DataPath:   t.TempDir(),
+	}, args)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = cmp.Run(ctx) }()
+
+	requireLines := func(expect ...string) {
+		t.Helper()
+		var lines []string
+		for len(lines) < len(expect) {
+			select {
+			case entry := <-recv.Chan():
+				lines = append(lines, entry.Line)
+			case <-time.After(5 * time.Second):
+				require.FailNow(t, "timed out waiting for entries", "received %v", lines)
+			}
+		}
+		select {
+		case entry := <-recv.Chan():
+			require.FailNow(t, "unexpected entry", entry.Line)
+		case <-time.After(200 * time.Millisecond):
+		}
+		require.ElementsMatch(t, expect, lines)
+	}
+	requireLines("a first", "b first")
+
+	cmp.PauseAll()
+	for _, tgt := range cmp.manager.targets() {
+		require.Equal(t, dt.StatusPaused, tgt.Status())
+	}
+	d.AppendLines("a", "2023-12-09T09:16:58.000000000Z a second")
+	d.AppendLines("b", "2023-12-09T09:16:58.000000000Z b second")
+	requireLines()
+
+	// Reading continues from the position at which the targets were paused.
+	cmp.ResumeAll()
+	requireLines("a second", "b second")
+}
+
+func TestUserAgent(t *testing.T) {
+	tests := map[string]struct {
+		userAgent string
+		expect    string
+	}{
+		"default": {userAgent: "", expect: userAgent},
+		"custom":  {userAgent: "maintenance-audit/1.0", expect: "maintenance-audit/1.0"},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			d := fakedocker.New(t)
+			d.AddContainer("a", "/a", "2023-12-09T09:16:57.000000000Z a first")
+
+			args := GetDefaultArguments()
+			args.Host = d.URL()
+			args.Targets = []discovery.Target{{dockerLabelContainerID: "a"}}
+			args.UserAgent = tc.userAgent
+			recv := loki.NewLogsReceiver()
+			args.ForwardTo = []loki.LogsReceiver{recv}
+
+			cmp, err := New(component.Options{
+				ID:         "loki.source.docker.test",
+				Logger:     util.TestFlowLogger(t),
+				Registerer: prometheus.NewRegistry(),
+				DataPath:   t.TempDir(),
+			}, args)
+			require.NoError(t, err)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go func() { _ = cmp.Run(ctx) }()
+
+			select {
+			case <-recv.Chan():
+			case <-time.After(5 * time.Second):
+				require.FailNow(t, "timed out waiting for entries")
+			}
+			require.True(t, d.SeenUserAgent(tc.expect))
+		})
+	}
+	require.Contains(t, userAgent, "GrafanaAgent/")
+}
+
+func TestReconnectRateLimit(t *testing.T) {
+	d := fakedocker.New(t)
+	d.AddContainer("a", "/a", "2023-12-09T09:16:57.000000000Z a first")
+	d.AddContainer("b", "/b", "2023-12-09T09:16:57.000000000Z b first")
+
+	args := GetDefaultArguments()
+	args.Host = d.URL()
+	args.Targets = []discovery.Target{
+		{dockerLabelContainerID: "a"},
+		{dockerLabelContainerID: "b"},
+	}
+	recv := loki.NewLogsReceiver()
+	args.ForwardTo = []loki.LogsReceiver{recv}
+	args.ReconnectRateLimit = 0.001
+	args.ReconnectBurst = 1
+
+	reg := prometheus.NewRegistry()
+	cmp, err := New(component.Options{
+		ID:         "loki.source.docker.test",
+		Logger:     util.TestFlowLogger(t),
+		Registerer: reg,
+		DataPath:   t.TempDir(),
+	}, args)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = cmp.Run(ctx) }()
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-recv.Chan():
+			}
+		}
+	}()
+
+	attaches := func() int { return len(d.Attaches("a")) + len(d.Attaches("b")) }
+	throttled := func() float64 {
+		mfs, err := reg.Gather()
+		require.NoError(t, err)
+		for _, mf := range mfs {
+			if mf.GetName() == "loki_source_docker_target_reconnects_throttled_total" {
+				return mf.GetMetric()[0].GetCounter().GetValue()
+			}
+		}
+		return 0
+	}
+	// Connecting to the containers for the first time isn't limited.
+	require.Eventually(t, func() bool { return attaches() == 2 }, 5*time.Second, 10*time.Millisecond)
+	require.Zero(t, throttled())
+
+	// The targets are replaced by new ones with other labels. The first one
+	// takes the burst, while the second one is delayed.
+	args.Labels = map[string]string{"generation": "2"}
+	require.NoError(t, cmp.Update(args))
+	require.Eventually(t, func() bool { return throttled() == 1 }, 5*time.Second, 10*time.Millisecond)
+	time.Sleep(200 * time.Millisecond)
+	require.Equal(t, 3, attaches())
+}
+
+func TestArgumentsValidateReconnectRateLimit(t *testing.T) {
+	for _, cfg := range []string{"reconnect_rate_limit = 0", "reconnect_burst = 0"} {
+		var args Arguments
+		err := river.Unmarshal([]byte(`
+			host       = "tcp://127.0.0.1:9375"
+			targets    = []
+			forward_to = []
+			`+cfg), &args)
+		require.Error(t, err, cfg)
+	}
+}
@@ -0,0 +1,83 @@
+package dockertarget
+
+import (
+	"encoding/json"
+	"io"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/grafana/agent/component/common/loki"
+	"github.com/prometheus/common/model"
+)
+
+// debugTee writes entries to Options.DebugWriter as NDJSON, one object per
+// entry. Writes are serialized with the lock of the writer, which is shared
+// by all targets writing to it.
+type debugTee struct {
+	mut *sync.Mutex
+	w   io.Writer
+}
+
+// debugWriterLocks holds the lock of every debug writer. Writers are
+// expected to be few and long-lived, e.g. os.Stdout, so locks are never
+// removed.
+var debugWriterLocks = struct {
+	sync.Mutex
+	locks map[io.Writer]*sync.Mutex
+}{locks: make(map[io.Writer]*sync.Mutex)}
+
+// debugWriterLock returns the lock shared by the debug tees writing to w.
+// Writers which can't be used as a map key get a lock of their own, so they
+// must be safe for concurrent use if they're shared by targets.
+func debugWriterLock(w io.Writer) *sync.Mutex {
+	if !reflect.TypeOf(w).Comparable() {
+		return new(sync.Mutex)
+	}
+	debugWriterLocks.Lock()
+	defer debugWriterLocks.Unlock()
+	mut, ok := debugWriterLocks.locks[w]
+	if !ok {
+		mut = new(sync.Mutex)
+		debugWriterLocks.locks[w] = mut
+	}
+	return mut
+}
+
+// debugEntry is the JSON representation of an entry written to the debug
+// writer.
+type debugEntry struct {
+	Labels    model.LabelSet `json:"labels"`
+	Timestamp time.Time      `json:"timestamp"`
+	Line      string         `json:"line"`
+}
+
+// newDebugTee returns a debugTee writing to w, or nil if w is nil.
+func newDebugTee(w io.Writer) *debugTee {
+	if w == nil {
+		return nil
+	}
+	return &debugTee{mut: debugWriterLock(w), w: w}
+}
+
+// Write writes the entry as a single line of JSON. It's a no-op on a nil
+// debugTee.
+func (d *debugTee) Write(entry loki.Entry) error {
+	if d == nil {
+		return nil
+	}
+	buf, err := json.Marshal(debugEntry{
+		Labels:    entry.Labels,
+		Timestamp: entry.Timestamp,
+		Line:      entry.Line,
+	})
+	if err != nil {
+		return err
+	}
+	buf = append(buf, '\n')
+
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	_, err = d.w.Write(buf)
+	return err
+}
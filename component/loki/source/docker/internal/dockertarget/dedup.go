@@ -0,0 +1,111 @@
+package dockertarget
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// dedupWindow remembers the entries sent for the most recent second. Docker
+// only supports a resolution of seconds for the since parameter, so a
+// re-established log stream starts over at the beginning of that second and
+// the entries which were already sent must be skipped.
+type dedupWindow struct {
+	mut    sync.Mutex
+	second int64
+	counts map[uint64]int
+}
+
+func newDedupWindow() *dedupWindow {
+	return &dedupWindow{counts: make(map[uint64]int)}
+}
+
+// entryHash identifies an entry read from a log stream.
+func entryHash(logStream string, ts time.Time, line string) uint64 {
+	h := xxhash.New()
+	_, _ = h.WriteString(logStream)
+	_, _ = h.WriteString(strconv.FormatInt(ts.UnixNano(), 10))
+	_, _ = h.WriteString(line)
+	return h.Sum64()
+}
+
+// Add records a sent entry. Entries of a different second replace the
+// window.
+func (w *dedupWindow) Add(logStream string, ts time.Time, line string) {
+	hash := entryHash(logStream, ts, line)
+
+	w.mut.Lock()
+	defer w.mut.Unlock()
+
+	if sec := ts.Unix(); sec != w.second {
+		w.second = sec
+		w.counts = make(map[uint64]int)
+	}
+	w.counts[hash]++
+}
+
+// Replay returns the entries to skip when reading the log stream again from
+// since. It returns nil if the window doesn't cover since.
+func (w *dedupWindow) Replay(since int64) *dedupReplay {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+
+	if w.second != since || len(w.counts) == 0 {
+		return nil
+	}
+	counts := make(map[uint64]int, len(w.counts))
+	for k, v := range w.counts {
+		counts[k] = v
+	}
+	return &dedupReplay{second: since, counts: counts}
+}
+
+func (w *dedupWindow) state() (int64, map[uint64]int) {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+
+	counts := make(map[uint64]int, len(w.counts))
+	for k, v := range w.counts {
+		counts[k] = v
+	}
+	return w.second, counts
+}
+
+func (w *dedupWindow) restore(second int64, counts map[uint64]int) {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+
+	w.second = second
+	w.counts = make(map[uint64]int, len(counts))
+	for k, v := range counts {
+		w.counts[k] = v
+	}
+}
+
+// dedupReplay tracks the already sent entries while a log stream is read
+// again. It is shared by the stdout and stderr readers of a stream.
+type dedupReplay struct {
+	mut    sync.Mutex
+	second int64
+	counts map[uint64]int
+}
+
+// Seen reports whether the entry was already sent and must be skipped. Each
+// sent entry is only skipped once, so that repeated identical lines are
+// still sent as often as they were logged.
+func (r *dedupReplay) Seen(logStream string, ts time.Time, line string) bool {
+	if r == nil || ts.Unix() != r.second {
+		return false
+	}
+	hash := entryHash(logStream, ts, line)
+
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	if r.counts[hash] == 0 {
+		return false
+	}
+	r.counts[hash]--
+	return true
+}
@@ -0,0 +1,64 @@
+package dockertarget
+
+import (
+	"bytes"
+	"context"
+)
+
+// streamLine is a line read from one of the log streams of a container.
+type streamLine struct {
+	stream string // stdout or stderr
+	line   string
+}
+
+// lineWriter splits the output written to one of the log streams of a
+// container into lines. The writers of both log streams share a channel, so
+// that their lines are received in the order they were demultiplexed in.
+type lineWriter struct {
+	ctx    context.Context
+	stream string
+	lines  chan<- streamLine
+	buf    []byte
+}
+
+func newLineWriter(ctx context.Context, stream string, lines chan<- streamLine) *lineWriter {
+	return &lineWriter{ctx: ctx, stream: stream, lines: lines}
+}
+
+// Write sends the lines completed by p. It blocks until they're received,
+// or fails once the context is canceled.
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	rest := w.buf
+	for {
+		i := bytes.IndexByte(rest, '\n')
+		if i < 0 {
+			break
+		}
+		if err := w.send(string(bytes.TrimSuffix(rest[:i], []byte("\r")))); err != nil {
+			return 0, err
+		}
+		rest = rest[i+1:]
+	}
+	w.buf = append(w.buf[:0], rest...)
+	return len(p), nil
+}
+
+// Flush sends the last line if it wasn't terminated by a newline.
+func (w *lineWriter) Flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	line := string(w.buf)
+	w.buf = w.buf[:0]
+	return w.send(line)
+}
+
+func (w *lineWriter) send(line string) error {
+	select {
+	case <-w.ctx.Done():
+		return w.ctx.Err()
+	case w.lines <- streamLine{stream: w.stream, line: line}:
+		return nil
+	}
+}
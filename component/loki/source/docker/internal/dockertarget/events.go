@@ -0,0 +1,190 @@
+package dockertarget
+
+import (
+	"context"
+	"path"
+	"strings"
+	"time"
+
+	docker_types "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/grafana/agent/pkg/flow/logging/level"
+)
+
+// refreshActions are the container event actions which may change whether
+// the target should be attached to the container, or which indicate that a
+// stopped container was started again.
+var refreshActions = map[string]struct{}{
+	"health_status": {},
+	"pause":         {},
+	"rename":        {},
+	"start":         {},
+	"unpause":       {},
+}
+
+// maxEventsBackoff bounds the delay before resubscribing to container events
+// after the subscription failed.
+const maxEventsBackoff = time.Minute
+
+// isRefreshAction reports whether an event action is one of refreshActions.
+// Health status events carry the new status in their action, e.g.
+// "health_status: unhealthy".
+func isRefreshAction(action string) bool {
+	name, _, _ := strings.Cut(action, ":")
+	_, ok := refreshActions[name]
+	return ok
+}
+
+// watchEvents subscribes to the events of the target's container until ctx is
+// canceled. The returned channel receives a value whenever an event may have
+// changed the attach conditions or the container was started; events
+// arriving while a value is pending are coalesced. With
+// Options.RefreshDebounce set, the events arriving within the window after an
+// event are coalesced as well. If the subscription fails, it's re-established
+// with a backoff starting at the attach poll interval, and a value is sent
+// once it is, as events may have been missed meanwhile.
+func (t *Target) watchEvents(ctx context.Context) <-chan struct{} {
+	refresh := make(chan struct{}, 1)
+
+	subscribe := func() (<-chan events.Message, <-chan error) {
+		return t.client.Events(ctx, docker_types.EventsOptions{
+			Filters: filters.NewArgs(
+				filters.Arg("type", events.ContainerEventType),
+				filters.Arg("container", t.containerName),
+			),
+		})
+	}
+	msgs, errs := subscribe()
+
+	signal := func() {
+		select {
+		case refresh <- struct{}{}:
+		default:
+		}
+	}
+
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		var (
+			debounce <-chan time.Time
+			backoff  time.Duration
+		)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-debounce:
+				debounce = nil
+				signal()
+			case err := <-errs:
+				if ctx.Err() != nil {
+					return
+				}
+				if backoff == 0 {
+					backoff = t.attachPollInterval()
+				} else {
+					backoff = min(2*backoff, maxEventsBackoff)
+				}
+				level.Warn(t.logger).Log("msg", "could not watch container events, resubscribing", "container", t.containerName, "err", err, "backoff", backoff)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(backoff):
+				}
+				msgs, errs = subscribe()
+				signal()
+			case msg := <-msgs:
+				backoff = 0
+				if !isRefreshAction(msg.Action) {
+					continue
+				}
+				t.recordHealthChange(msg)
+				if t.opts.RefreshDebounce <= 0 {
+					signal()
+				} else if debounce == nil {
+					debounce = time.After(t.opts.RefreshDebounce)
+				}
+			}
+		}
+	}()
+
+	return refresh
+}
+
+// recordHealthChange records the time of a health status event changing the
+// status of the container to Options.HealthStatus.
+func (t *Target) recordHealthChange(msg events.Message) {
+	if t.opts.HealthStatus == "" {
+		return
+	}
+	name, status, _ := strings.Cut(msg.Action, ":")
+	if name != "health_status" || strings.TrimSpace(status) != t.opts.HealthStatus {
+		return
+	}
+	changed := time.Now()
+	if msg.TimeNano != 0 {
+		changed = time.Unix(0, msg.TimeNano)
+	} else if msg.Time != 0 {
+		changed = time.Unix(msg.Time, 0)
+	}
+	t.healthChanged.Store(changed.Unix())
+}
+
+// shouldAttach reports whether the container matches the attach conditions
+// of the target.
+func (t *Target) shouldAttach(info docker_types.ContainerJSON) bool {
+	if t.pausedDetach(info) {
+		return false
+	}
+	if t.opts.NameGlob != "" {
+		// Container names are reported with a leading slash.
+		if ok, _ := path.Match(t.opts.NameGlob, strings.TrimPrefix(info.Name, "/")); !ok {
+			return false
+		}
+	}
+	if t.opts.User != "" && !hasUser(info, t.opts.User) {
+		return false
+	}
+	if t.opts.HealthStatus != "" && healthStatus(info) != t.opts.HealthStatus {
+		return false
+	}
+	if t.opts.RequiredLabel != "" && !hasLabel(info, t.opts.RequiredLabel) {
+		return false
+	}
+	return true
+}
+
+// pausedDetach reports whether the target doesn't attach to the container
+// because it's paused.
+func (t *Target) pausedDetach(info docker_types.ContainerJSON) bool {
+	return t.opts.DetachOnPause && info.ContainerJSONBase != nil && info.State != nil && info.State.Paused
+}
+
+// healthStatus returns the health status of the container, or an empty
+// string if it doesn't have a health check.
+func healthStatus(info docker_types.ContainerJSON) string {
+	if info.ContainerJSONBase == nil || info.State == nil || info.State.Health == nil {
+		return ""
+	}
+	return info.State.Health.Status
+}
+
+// hasUser reports whether the container is run by the given user.
+func hasUser(info docker_types.ContainerJSON, user string) bool {
+	if info.Config == nil {
+		return false
+	}
+	name, _, _ := strings.Cut(info.Config.User, ":")
+	return info.Config.User == user || name == user
+}
+
+// hasLabel reports whether the container has the given label.
+func hasLabel(info docker_types.ContainerJSON, name string) bool {
+	if info.Config == nil {
+		return false
+	}
+	_, ok := info.Config.Labels[name]
+	return ok
+}
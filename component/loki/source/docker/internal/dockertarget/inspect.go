@@ -0,0 +1,47 @@
+package dockertarget
+
+import (
+	"context"
+	"time"
+
+	docker_types "github.com/docker/docker/api/types"
+	"github.com/docker/docker/errdefs"
+	"github.com/grafana/agent/pkg/flow/logging/level"
+)
+
+const (
+	// defaultInspectRetries is the number of times a failed inspect is retried
+	// if Options.InspectRetries is unset.
+	defaultInspectRetries = 3
+	// defaultInspectBackoff is the initial delay before retrying a failed
+	// inspect if Options.InspectBackoff is unset.
+	defaultInspectBackoff = 100 * time.Millisecond
+)
+
+// inspect returns the inspect information of the container, retrying failed
+// attempts as configured by Options.InspectRetries, unless the container
+// doesn't exist.
+func (t *Target) inspect(ctx context.Context) (docker_types.ContainerJSON, error) {
+	retries := t.opts.InspectRetries
+	if retries == 0 {
+		retries = defaultInspectRetries
+	}
+	backoff := t.opts.InspectBackoff
+	if backoff <= 0 {
+		backoff = defaultInspectBackoff
+	}
+
+	for attempt := 0; ; attempt++ {
+		info, err := t.client.ContainerInspect(ctx, t.containerName)
+		if err == nil || attempt >= retries || errdefs.IsNotFound(err) || ctx.Err() != nil {
+			return info, err
+		}
+		level.Warn(t.logger).Log("msg", "could not inspect container info, retrying", "container", t.containerName, "err", err, "backoff", backoff)
+		select {
+		case <-ctx.Done():
+			return info, err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
@@ -0,0 +1,66 @@
+package dockertarget
+
+import "strings"
+
+// continuationJoiner joins soft-wrapped lines, i.e. lines ending with a
+// continuation marker, with the lines following them.
+type continuationJoiner struct {
+	marker   string
+	maxLines int
+
+	lines int
+	ts    lineStamp
+	buf   strings.Builder
+}
+
+// newContinuationJoiner returns a continuationJoiner for the given marker.
+// Joined entries are complete after maxLines lines, even if the last one
+// ends with the marker. An empty marker disables joining.
+func newContinuationJoiner(marker string, maxLines int) *continuationJoiner {
+	return &continuationJoiner{marker: marker, maxLines: maxLines}
+}
+
+// Add adds a line to the joiner. It returns the line to emit and true once an
+// entry is complete, or false if the line is waiting for its continuation.
+// Joined entries keep the timestamp of their first line.
+func (j *continuationJoiner) Add(ts lineStamp, line string) (lineStamp, string, bool) {
+	if j.marker == "" {
+		return ts, line, true
+	}
+
+	if strings.HasSuffix(line, j.marker) {
+		if j.lines == 0 {
+			j.ts = ts
+		}
+		j.buf.WriteString(strings.TrimSuffix(line, j.marker))
+		j.lines++
+		if j.lines >= j.maxLines {
+			return j.Flush()
+		}
+		return lineStamp{}, "", false
+	}
+
+	if j.lines == 0 {
+		return ts, line, true
+	}
+	j.buf.WriteString(line)
+	return j.Flush()
+}
+
+// Held returns the timestamps of the entry waiting for its continuation, if
+// any.
+func (j *continuationJoiner) Held() (lineStamp, bool) {
+	return j.ts, j.lines > 0
+}
+
+// Flush returns the pending joined entry, if any, and resets the joiner.
+func (j *continuationJoiner) Flush() (lineStamp, string, bool) {
+	if j.lines == 0 {
+		return lineStamp{}, "", false
+	}
+	ts, line := j.ts, j.buf.String()
+	j.lines = 0
+	j.ts = lineStamp{}
+	j.buf.Reset()
+	return ts, line, true
+}
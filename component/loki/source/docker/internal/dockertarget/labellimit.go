@@ -0,0 +1,72 @@
+package dockertarget
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"golang.org/x/time/rate"
+)
+
+// LabelRateLimiter limits the rate of entries per value of a label, e.g. per
+// compose service, so that the entries of one value can't crowd out the
+// ones of others. Every value has its own token bucket. It can be shared by
+// several targets, to limit the values across them. The buckets of values
+// which are full again are evicted, as they limit like new ones, so that
+// values no longer seen don't accumulate.
+type LabelRateLimiter struct {
+	label model.LabelName
+	limit rate.Limit
+	burst int
+
+	mut      sync.Mutex
+	limiters map[model.LabelValue]*rate.Limiter
+	swept    time.Time // last time the full buckets were evicted
+}
+
+// labelLimiterSweepInterval is how often the buckets of a LabelRateLimiter
+// are checked to evict the full ones.
+const labelLimiterSweepInterval = time.Minute
+
+// NewLabelRateLimiter returns a LabelRateLimiter allowing limit entries per
+// second for every value of label, with bursts of up to burst entries. burst
+// must be at least one.
+func NewLabelRateLimiter(label model.LabelName, limit rate.Limit, burst int) *LabelRateLimiter {
+	return &LabelRateLimiter{
+		label:    label,
+		limit:    limit,
+		burst:    burst,
+		limiters: make(map[model.LabelValue]*rate.Limiter),
+	}
+}
+
+// allow reports whether an entry with the given labels is within the limit
+// of its label value. Entries without the label aren't limited.
+func (l *LabelRateLimiter) allow(lset model.LabelSet, now time.Time) bool {
+	value, ok := lset[l.label]
+	if !ok {
+		return true
+	}
+
+	l.mut.Lock()
+	if now.Sub(l.swept) >= labelLimiterSweepInterval {
+		l.evictFull(now)
+	}
+	limiter, ok := l.limiters[value]
+	if !ok {
+		limiter = rate.NewLimiter(l.limit, l.burst)
+		l.limiters[value] = limiter
+	}
+	l.mut.Unlock()
+	return limiter.AllowN(now, 1)
+}
+
+// evictFull removes the buckets which are full at now. l.mut must be held.
+func (l *LabelRateLimiter) evictFull(now time.Time) {
+	for value, limiter := range l.limiters {
+		if limiter.TokensAt(now) >= float64(l.burst) {
+			delete(l.limiters, value)
+		}
+	}
+	l.swept = now
+}
@@ -0,0 +1,46 @@
+package dockertarget
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/Masterminds/sprig/v3"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// labelTemplate renders the value of a label from the labels of a target.
+type labelTemplate struct {
+	name model.LabelName
+	tmpl *template.Template
+}
+
+// parseLabelTemplates parses the templates of Options.LabelTemplates, ordered
+// by label name.
+func parseLabelTemplates(templates map[string]string) ([]labelTemplate, error) {
+	res := make([]labelTemplate, 0, len(templates))
+	for name, text := range templates {
+		if !model.LabelName(name).IsValid() {
+			return nil, fmt.Errorf("invalid label name %q for label template", name)
+		}
+		// Missing keys render as empty strings rather than "<no value>".
+		tmpl, err := template.New(name).Funcs(sprig.TxtFuncMap()).Option("missingkey=zero").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template for label %q: %w", name, err)
+		}
+		res = append(res, labelTemplate{name: model.LabelName(name), tmpl: tmpl})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].name < res[j].name })
+	return res, nil
+}
+
+// render evaluates the template over lset, keyed by label name.
+func (lt labelTemplate) render(lset labels.Labels) (string, error) {
+	var sb strings.Builder
+	if err := lt.tmpl.Execute(&sb, lset.Map()); err != nil {
+		return "", err
+	}
+	return sb.String(), nil
+}
@@ -0,0 +1,69 @@
+package dockertarget
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// defaultLevelField is the field of JSON lines holding the level if
+// Options.LevelField is unset.
+const defaultLevelField = "level"
+
+// severities orders the known levels by severity. Aliases share the
+// severity of the level they stand for.
+var severities = map[string]int{
+	"trace":    0,
+	"debug":    1,
+	"info":     2,
+	"notice":   2,
+	"warn":     3,
+	"warning":  3,
+	"error":    4,
+	"err":      4,
+	"critical": 5,
+	"crit":     5,
+	"fatal":    5,
+	"panic":    5,
+}
+
+// levelFilter drops JSON lines whose level is below a threshold.
+type levelFilter struct {
+	field     string
+	threshold int
+}
+
+// newLevelFilter returns a filter for Options.MinLevel, or nil if it's unset.
+func newLevelFilter(opts Options) (*levelFilter, error) {
+	if opts.MinLevel == "" {
+		return nil, nil
+	}
+	threshold, ok := severities[strings.ToLower(opts.MinLevel)]
+	if !ok {
+		return nil, fmt.Errorf("unknown minimum level %q", opts.MinLevel)
+	}
+	field := opts.LevelField
+	if field == "" {
+		field = defaultLevelField
+	}
+	return &levelFilter{field: field, threshold: threshold}, nil
+}
+
+// Drop reports whether the line is below the threshold. Lines which aren't
+// JSON objects, or which don't have a known level, are kept. It's a no-op on
+// a nil levelFilter.
+func (f *levelFilter) Drop(line string) bool {
+	if f == nil || !strings.HasPrefix(strings.TrimSpace(line), "{") {
+		return false
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(line), &fields); err != nil {
+		return false
+	}
+	var level string
+	if err := json.Unmarshal(fields[f.field], &level); err != nil {
+		return false
+	}
+	severity, ok := severities[strings.ToLower(level)]
+	return ok && severity < f.threshold
+}
@@ -0,0 +1,118 @@
+package dockertarget
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/grafana/agent/component/common/loki/positions"
+	"github.com/grafana/agent/pkg/flow/logging/level"
+)
+
+// defaultMaxReconnectsWindow is the window reconnects are counted in if
+// Options.MaxReconnectsWindow is unset.
+const defaultMaxReconnectsWindow = time.Minute
+
+// startContext returns the context of a new process loop. It expires once
+// the lifetime of the target is over, which starts when the target is
+// started for the first time. It returns false if the lifetime is already
+// over. Canceling the context with a cause other than context.Canceled
+// stops the target with that error.
+func (t *Target) startContext() (context.Context, context.CancelCauseFunc, bool) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	if t.opts.MaxLifetime <= 0 {
+		return ctx, cancel, true
+	}
+
+	t.mut.Lock()
+	if t.deadline.IsZero() {
+		t.deadline = time.Now().Add(t.opts.MaxLifetime)
+	}
+	deadline := t.deadline
+	t.mut.Unlock()
+
+	if !time.Now().Before(deadline) {
+		cancel(nil)
+		return nil, nil, false
+	}
+	ctx, cancelDeadline := context.WithDeadline(ctx, deadline)
+	return ctx, func(cause error) {
+		cancel(cause)
+		cancelDeadline()
+	}, true
+}
+
+// stopped is called once the process loop exited. Unless the target was
+// stopped by Stop or Pause, the position is recorded and written to the
+// positions file, as the target won't record it anymore, and Options.OnStop
+// is called.
+func (t *Target) stopped(ctx context.Context) {
+	var err error
+	switch cause := context.Cause(ctx); {
+	case cause == nil:
+		err = t.err
+	case errors.Is(cause, context.DeadlineExceeded):
+		level.Info(t.logger).Log("msg", "stopping Docker target as its maximum lifetime is over", "container", t.containerName, "lifetime", t.opts.MaxLifetime)
+	case errors.Is(cause, context.Canceled):
+		return
+	default:
+		// The target gave up, e.g. after too many reconnects.
+		t.err = cause
+		err = cause
+	}
+	if since := t.since.Load(); since > 0 {
+		t.putPosition(since)
+	}
+	if syncer, ok := t.positions.(positions.Syncer); ok {
+		syncer.Sync()
+	}
+	if t.opts.OnStop != nil {
+		t.opts.OnStop(err)
+	}
+}
+
+// countReconnect counts re-establishing the log stream for reason. It returns
+// an error, without counting the reconnect, once there were more than
+// Options.MaxReconnects reconnects within the window, in which case the
+// target gives up.
+func (t *Target) countReconnect(reason string) error {
+	if err := t.recordReconnect(time.Now()); err != nil {
+		level.Error(t.logger).Log("msg", "giving up reconnecting to Docker log stream", "container", t.containerName, "reason", reason, "err", err)
+		return err
+	}
+	level.Info(t.logger).Log("msg", "reconnecting to Docker log stream", "container", t.containerName, "reason", reason)
+	t.metrics.dockerReconnects.WithLabelValues(reason).Inc()
+	t.counters.reconnects.Inc()
+
+	t.mut.Lock()
+	t.reconnectReason = reason
+	t.mut.Unlock()
+	return nil
+}
+
+// recordReconnect records a reconnect at now. It returns an error once there
+// were more than Options.MaxReconnects reconnects within the window.
+func (t *Target) recordReconnect(now time.Time) error {
+	if t.opts.MaxReconnects <= 0 {
+		return nil
+	}
+	window := t.opts.MaxReconnectsWindow
+	if window <= 0 {
+		window = defaultMaxReconnectsWindow
+	}
+
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	keep := t.reconnects[:0]
+	for _, ts := range t.reconnects {
+		if now.Sub(ts) < window {
+			keep = append(keep, ts)
+		}
+	}
+	t.reconnects = append(keep, now)
+	if len(t.reconnects) > t.opts.MaxReconnects {
+		return fmt.Errorf("reconnected to the log stream more than %d times within %s", t.opts.MaxReconnects, window)
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package dockertarget
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"text/template"
+
+	docker_types "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/grafana/agent/pkg/flow/logging/level"
+	"github.com/prometheus/common/model"
+)
+
+// Meta labels derived from the inspect information of a container. They are
+// available to relabeling rules in addition to the discovered labels.
+const (
+	dockerLabelContainerMemoryLimit = dockerLabelContainerPrefix + "memory_limit"
+	dockerLabelContainerCPUShares   = dockerLabelContainerPrefix + "cpu_shares"
+	dockerLabelContainerPID         = dockerLabelContainerPrefix + "pid"
+	dockerLabelContainerLogTag      = dockerLabelContainerPrefix + "log_tag"
+	dockerLabelContainerUser        = dockerLabelContainerPrefix + "user"
+
+	// dockerLabelContainerOS and dockerLabelContainerArch are the operating
+	// system and architecture of the container, if Options.PlatformLabels is
+	// set.
+	dockerLabelContainerOS   = dockerLabelContainerPrefix + "os"
+	dockerLabelContainerArch = dockerLabelContainerPrefix + "arch"
+
+	// dockerLabelContainerLogTimestampPrecision is the precision of the
+	// timestamps the logging driver of the container records lines with.
+	dockerLabelContainerLogTimestampPrecision = dockerLabelContainerPrefix + "log_timestamp_precision"
+)
+
+// Precisions of the timestamps recorded by logging drivers.
+const (
+	timestampPrecisionNanosecond  = "nanosecond"
+	timestampPrecisionMicrosecond = "microsecond"
+)
+
+// inspectLabels returns the meta labels derived from the inspect information
+// of a container. Labels for unset values are omitted.
+func inspectLabels(info docker_types.ContainerJSON) model.LabelSet {
+	lset := make(model.LabelSet)
+	if info.ContainerJSONBase == nil {
+		return lset
+	}
+
+	if hc := info.HostConfig; hc != nil {
+		if hc.Memory > 0 {
+			lset[dockerLabelContainerMemoryLimit] = model.LabelValue(strconv.FormatInt(hc.Memory, 10))
+		}
+		if hc.CPUShares > 0 {
+			lset[dockerLabelContainerCPUShares] = model.LabelValue(strconv.FormatInt(hc.CPUShares, 10))
+		}
+		if tag := hc.LogConfig.Config["tag"]; tag != "" {
+			lset[dockerLabelContainerLogTag] = model.LabelValue(resolveLogTag(tag, info))
+		}
+		if precision := logTimestampPrecision(hc.LogConfig); precision != "" {
+			lset[dockerLabelContainerLogTimestampPrecision] = model.LabelValue(precision)
+		}
+	}
+	if cfg := info.Config; cfg != nil && cfg.User != "" {
+		lset[dockerLabelContainerUser] = model.LabelValue(cfg.User)
+	}
+	if state := info.State; state != nil && state.Pid > 0 {
+		lset[dockerLabelContainerPID] = model.LabelValue(strconv.Itoa(state.Pid))
+	}
+	return lset
+}
+
+// platformLabels returns the meta labels with the platform of a container.
+// The operating system is taken from the container, and the architecture
+// from its image, which is inspected for it. Labels which can't be
+// determined are omitted.
+func (t *Target) platformLabels(ctx context.Context, info docker_types.ContainerJSON) model.LabelSet {
+	lset := make(model.LabelSet)
+	if info.ContainerJSONBase == nil {
+		return lset
+	}
+	if info.Platform != "" {
+		lset[dockerLabelContainerOS] = model.LabelValue(info.Platform)
+	}
+
+	image, _, err := t.client.ImageInspectWithRaw(ctx, info.Image)
+	if err != nil {
+		level.Debug(t.logger).Log("msg", "could not inspect the image of the container for its platform", "container", t.containerName, "image", info.Image, "err", err)
+		return lset
+	}
+	if _, ok := lset[dockerLabelContainerOS]; !ok && image.Os != "" {
+		lset[dockerLabelContainerOS] = model.LabelValue(image.Os)
+	}
+	if image.Architecture != "" {
+		arch := image.Architecture
+		if image.Variant != "" {
+			arch += "/" + image.Variant
+		}
+		lset[dockerLabelContainerArch] = model.LabelValue(arch)
+	}
+	return lset
+}
+
+// logTimestampPrecision returns the precision of the timestamps the log
+// stream of a container has, as derived from its logging driver, or an empty
+// string if the log stream can't be read. The journald driver records
+// microseconds; the json-file and local drivers, as well as the cache of
+// other drivers with dual logging, record nanoseconds.
+func logTimestampPrecision(cfg container.LogConfig) string {
+	switch cfg.Type {
+	case "", "none":
+		return ""
+	case "json-file", "local":
+		return timestampPrecisionNanosecond
+	case "journald":
+		return timestampPrecisionMicrosecond
+	}
+	if cfg.Config["cache-disabled"] == "true" {
+		return ""
+	}
+	return timestampPrecisionNanosecond
+}
+
+// logTagContext holds the fields available to log tag templates, as
+// documented at https://docs.docker.com/config/containers/logging/log_tags/.
+type logTagContext struct {
+	ID          string
+	FullID      string
+	Name        string
+	ImageID     string
+	ImageFullID string
+	ImageName   string
+	DaemonName  string
+}
+
+// resolveLogTag renders a log tag template the same way the logging driver
+// does. The tag is returned as is if it can't be rendered.
+func resolveLogTag(tag string, info docker_types.ContainerJSON) string {
+	tmpl, err := template.New("log-tag").Parse(tag)
+	if err != nil {
+		return tag
+	}
+
+	imageID := strings.TrimPrefix(info.Image, "sha256:")
+	ctx := logTagContext{
+		ID:          truncateID(info.ID),
+		FullID:      info.ID,
+		Name:        strings.TrimPrefix(info.Name, "/"),
+		ImageID:     truncateID(imageID),
+		ImageFullID: imageID,
+		DaemonName:  "docker",
+	}
+	if info.Config != nil {
+		ctx.ImageName = info.Config.Image
+	}
+
+	var sb strings.Builder
+	if err := tmpl.Execute(&sb, ctx); err != nil {
+		return tag
+	}
+	return sb.String()
+}
+
+// truncateID shortens a container or image ID to the length shown by Docker.
+func truncateID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
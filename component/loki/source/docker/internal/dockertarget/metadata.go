@@ -0,0 +1,75 @@
+package dockertarget
+
+import (
+	"sort"
+	"unicode/utf8"
+
+	docker_types "github.com/docker/docker/api/types"
+	"github.com/grafana/loki/pkg/logproto"
+	"github.com/prometheus/prometheus/util/strutil"
+)
+
+const (
+	// defaultMetadataMaxLabels is the maximum number of container labels
+	// attached as structured metadata if Options.MetadataMaxLabels is unset.
+	defaultMetadataMaxLabels = 32
+	// defaultMetadataMaxValueLength is the maximum length in bytes of the
+	// values of container labels attached as structured metadata if
+	// Options.MetadataMaxValueLength is unset.
+	defaultMetadataMaxValueLength = 256
+
+	// metadataReconnectGeneration holds the generation of the log stream if
+	// Options.AnnotateGeneration is set.
+	metadataReconnectGeneration = "reconnect_generation"
+	// metadataStartPosition holds the timestamp in seconds the log stream
+	// was read from if Options.AnnotateStartPosition is set.
+	metadataStartPosition = "start_position"
+)
+
+// labelsMetadata returns the labels of the container as structured metadata,
+// ordered by name and keyed by their sanitized name. It returns nil unless
+// Options.LabelsAsMetadata is set.
+func (t *Target) labelsMetadata(info docker_types.ContainerJSON) []logproto.LabelAdapter {
+	if !t.opts.LabelsAsMetadata || info.Config == nil || len(info.Config.Labels) == 0 {
+		return nil
+	}
+
+	maxLabels := t.opts.MetadataMaxLabels
+	if maxLabels <= 0 {
+		maxLabels = defaultMetadataMaxLabels
+	}
+	maxValueLength := t.opts.MetadataMaxValueLength
+	if maxValueLength <= 0 {
+		maxValueLength = defaultMetadataMaxValueLength
+	}
+
+	names := make([]string, 0, len(info.Config.Labels))
+	for name := range info.Config.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(names) > maxLabels {
+		names = names[:maxLabels]
+	}
+
+	res := make([]logproto.LabelAdapter, 0, len(names))
+	for _, name := range names {
+		res = append(res, logproto.LabelAdapter{
+			Name:  strutil.SanitizeLabelName(name),
+			Value: truncateString(info.Config.Labels[name], maxValueLength),
+		})
+	}
+	return res
+}
+
+// truncateString shortens s to at most n bytes without splitting a UTF-8
+// encoded character.
+func truncateString(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
@@ -4,14 +4,39 @@ package dockertarget
 // The dockertarget package is used to configure and run the targets that can
 // read logs from Docker containers and forward them to other loki components.
 
-import "github.com/prometheus/client_golang/prometheus"
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
 
 // Metrics holds a set of Docker target metrics.
 type Metrics struct {
 	reg prometheus.Registerer
 
-	dockerEntries prometheus.Counter
-	dockerErrors  prometheus.Counter
+	dockerEntries    prometheus.Counter
+	dockerErrors     prometheus.Counter
+	dockerReconnects *prometheus.CounterVec
+
+	dockerDedupSuppressed  prometheus.Counter
+	dockerRestartThrottled prometheus.Counter
+
+	dockerReconnectsThrottled prometheus.Counter
+
+	dockerIngestionLag prometheus.Histogram
+	dockerLagDropped   prometheus.Counter
+
+	dockerTruncated prometheus.Counter
+
+	dockerLastFlushedPositionTimestamp *prometheus.GaugeVec
+	flushedMut                         sync.Mutex
+	running                            map[string]int // running targets by container
+
+	dockerLevelFiltered prometheus.Counter
+
+	dockerNullBytes prometheus.Counter
+
+	dockerLabelRateLimited prometheus.Counter
 }
 
 // NewMetrics creates a new set of Docker target metrics. If reg is non-nil, the
@@ -28,11 +53,67 @@ func NewMetrics(reg prometheus.Registerer) *Metrics {
 		Name: "loki_source_docker_target_parsing_errors_total",
 		Help: "Total number of parsing errors while receiving Docker messages",
 	})
+	m.dockerReconnects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "loki_source_docker_target_reconnects_total",
+		Help: "Total number of times the Docker log stream was re-established, by reason",
+	}, []string{"reason"})
+	m.dockerDedupSuppressed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "loki_source_docker_target_dedup_suppressed_total",
+		Help: "Total number of lines read again after the Docker log stream was re-established which were skipped as already sent",
+	})
+	m.dockerRestartThrottled = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "loki_source_docker_target_restart_throttled_total",
+		Help: "Total number of times re-attaching to a container was delayed because it's restarting in a loop",
+	})
+	m.dockerReconnectsThrottled = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "loki_source_docker_target_reconnects_throttled_total",
+		Help: "Total number of times re-establishing the Docker log stream was delayed by the reconnect rate limit",
+	})
+	m.dockerIngestionLag = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "loki_source_docker_target_ingestion_lag_seconds",
+		Help:    "Time between the timestamp of Docker entries and the time they were read",
+		Buckets: []float64{.1, .5, 1, 5, 10, 30, 60, 300, 900, 3600},
+	})
+	m.dockerLagDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "loki_source_docker_target_lag_dropped_total",
+		Help: "Total number of Docker entries dropped because their ingestion lag exceeded the maximum lag",
+	})
+	m.dockerTruncated = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "loki_source_docker_target_truncated_entries_total",
+		Help: "Total number of Docker entries detected to be truncated",
+	})
+	m.dockerLastFlushedPositionTimestamp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "loki_source_docker_target_last_flushed_position_timestamp_seconds",
+		Help: "Timestamp of the last position of a Docker container written to the positions file, in seconds",
+	}, []string{"container"})
+	m.dockerLevelFiltered = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "loki_source_docker_target_level_filtered_total",
+		Help: "Total number of Docker entries dropped because their level was below the minimum level",
+	})
+	m.dockerNullBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "loki_source_docker_target_null_byte_entries_total",
+		Help: "Total number of Docker entries containing null bytes, which were replaced, stripped or dropped",
+	})
+	m.dockerLabelRateLimited = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "loki_source_docker_target_label_rate_limited_total",
+		Help: "Total number of Docker entries dropped because they exceeded the rate limit of their label value",
+	})
 
 	if reg != nil {
 		reg.MustRegister(
 			m.dockerEntries,
 			m.dockerErrors,
+			m.dockerReconnects,
+			m.dockerDedupSuppressed,
+			m.dockerRestartThrottled,
+			m.dockerReconnectsThrottled,
+			m.dockerIngestionLag,
+			m.dockerLagDropped,
+			m.dockerTruncated,
+			m.dockerLastFlushedPositionTimestamp,
+			m.dockerLevelFiltered,
+			m.dockerNullBytes,
+			m.dockerLabelRateLimited,
 		)
 	}
 
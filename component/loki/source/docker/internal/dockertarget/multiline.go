@@ -0,0 +1,98 @@
+package dockertarget
+
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultMultilineSeparator joins the lines of a multiline entry if
+	// Options.MultilineSeparator is unset.
+	defaultMultilineSeparator = "\n"
+	// defaultMultilineMaxWait is how long an incomplete multiline entry is
+	// held back if Options.MultilineMaxWait is unset.
+	defaultMultilineMaxWait = 3 * time.Second
+	// defaultMultilineMaxLines is the maximum number of lines of a multiline
+	// entry if Options.MultilineMaxLines is unset.
+	defaultMultilineMaxLines = 128
+)
+
+// multilineAggregator aggregates the lines following a line matching the
+// first line expression into a single entry, e.g. for stack traces.
+type multilineAggregator struct {
+	firstLine *regexp.Regexp
+	separator string
+	maxLines  int
+
+	lines int
+	ts    lineStamp
+	buf   strings.Builder
+}
+
+// newMultilineAggregator returns a multilineAggregator. A nil firstLine
+// disables aggregation.
+func newMultilineAggregator(firstLine *regexp.Regexp, separator string, maxLines int) *multilineAggregator {
+	return &multilineAggregator{
+		firstLine: firstLine,
+		separator: separator,
+		maxLines:  maxLines,
+	}
+}
+
+// Add adds a line to the aggregator. It returns the entry to emit and true
+// once an entry is complete, or false if the entry may still be continued.
+// Aggregated entries keep the timestamp of their first line. Lines before
+// the first line matching the expression are aggregated as well.
+func (a *multilineAggregator) Add(ts lineStamp, line string) (lineStamp, string, bool) {
+	if a.firstLine == nil {
+		return ts, line, true
+	}
+
+	var (
+		prevTs   lineStamp
+		prevLine string
+		flushed  bool
+	)
+	if a.lines > 0 && a.firstLine.MatchString(line) {
+		prevTs, prevLine, flushed = a.Flush()
+	}
+
+	if a.lines == 0 {
+		a.ts = ts
+	} else {
+		a.buf.WriteString(a.separator)
+	}
+	a.buf.WriteString(line)
+	a.lines++
+
+	if flushed {
+		return prevTs, prevLine, true
+	}
+	if a.lines >= a.maxLines {
+		return a.Flush()
+	}
+	return lineStamp{}, "", false
+}
+
+// Pending reports whether an incomplete entry is held back.
+func (a *multilineAggregator) Pending() bool {
+	return a.lines > 0
+}
+
+// Held returns the timestamps of the incomplete entry held back, if any.
+func (a *multilineAggregator) Held() (lineStamp, bool) {
+	return a.ts, a.lines > 0
+}
+
+// Flush returns the pending entry, if any, and resets the aggregator.
+func (a *multilineAggregator) Flush() (lineStamp, string, bool) {
+	if a.lines == 0 {
+		return lineStamp{}, "", false
+	}
+	ts, line := a.ts, a.buf.String()
+	a.lines = 0
+	a.ts = lineStamp{}
+	a.buf.Reset()
+	return ts, line, true
+}
@@ -0,0 +1,63 @@
+package dockertarget
+
+import (
+	"fmt"
+	"strings"
+)
+
+// NullBytePolicy is how lines containing null bytes are handled, as they may
+// be rejected or garbled when ingested.
+type NullBytePolicy string
+
+const (
+	// NullBytePolicyReplace replaces every null byte with
+	// Options.NullByteReplacement.
+	NullBytePolicyReplace NullBytePolicy = "replace"
+	// NullBytePolicyStrip removes null bytes from lines.
+	NullBytePolicyStrip NullBytePolicy = "strip"
+	// NullBytePolicyDrop drops lines containing null bytes.
+	NullBytePolicyDrop NullBytePolicy = "drop"
+)
+
+// defaultNullByteReplacement replaces null bytes if
+// Options.NullByteReplacement is unset.
+const defaultNullByteReplacement = "�"
+
+// nullByteFilter applies a NullBytePolicy to lines.
+type nullByteFilter struct {
+	policy      NullBytePolicy
+	replacement string
+}
+
+// newNullByteFilter validates the null byte options and returns a filter for
+// them.
+func newNullByteFilter(opts Options) (*nullByteFilter, error) {
+	f := &nullByteFilter{policy: opts.NullBytePolicy, replacement: opts.NullByteReplacement}
+	switch f.policy {
+	case "":
+		f.policy = NullBytePolicyReplace
+	case NullBytePolicyReplace, NullBytePolicyStrip, NullBytePolicyDrop:
+	default:
+		return nil, fmt.Errorf("unknown null byte policy %q", f.policy)
+	}
+	if f.replacement == "" {
+		f.replacement = defaultNullByteReplacement
+	}
+	return f, nil
+}
+
+// Apply returns the line with the policy applied, and whether the line
+// contained null bytes. The line is empty if it's to be dropped.
+func (f *nullByteFilter) Apply(line string) (string, bool) {
+	if !strings.Contains(line, "\x00") {
+		return line, false
+	}
+	switch f.policy {
+	case NullBytePolicyStrip:
+		return strings.ReplaceAll(line, "\x00", ""), true
+	case NullBytePolicyDrop:
+		return "", true
+	default:
+		return strings.ReplaceAll(line, "\x00", f.replacement), true
+	}
+}
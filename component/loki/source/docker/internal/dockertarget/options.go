@@ -0,0 +1,293 @@
+package dockertarget
+
+import (
+	"io"
+	"time"
+
+	docker_types "github.com/docker/docker/api/types"
+	"github.com/grafana/agent/component/common/loki"
+	"github.com/prometheus/common/model"
+)
+
+// Options holds optional settings of a Target. The zero value is ready to use.
+//
+// loki.source.docker, the only importer of this internal package, only sets
+// ReconnectLimiter. The other options aren't exposed as arguments of the
+// component, so they're internal-only and unreachable for users until they
+// are.
+type Options struct {
+	// ContinuationMarker, if set, joins lines ending with the marker with the
+	// line following it into a single entry. The marker is stripped from the
+	// joined entry. Like multiline entries, joined entries are flushed after
+	// MultilineMaxWait without more lines, or once they reach
+	// MultilineMaxLines lines.
+	ContinuationMarker string
+
+	// NameGlob, if set, only reads logs while the container name matches the
+	// glob, using the syntax of path.Match. The name is re-evaluated when the
+	// container is renamed.
+	NameGlob string
+
+	// User, if set, only reads logs of containers run by the given user, as
+	// set in the container configuration. It matches either the whole user,
+	// e.g. "1000:1000", or the part before the group, e.g. "1000".
+	User string
+
+	// HealthStatus, if set, only reads logs while the health status of the
+	// container is the given one, e.g. "unhealthy" to capture the logs of a
+	// container from the moment it becomes unhealthy until it's healthy
+	// again. The status is re-evaluated on health status events. Attaching
+	// because of a change to the status resumes from the time of the change,
+	// so that logs from before it aren't read.
+	HealthStatus string
+
+	// RecentEntriesSize is the number of most recent entries kept for
+	// RecentEntries. Defaults to 10 if zero or less.
+	RecentEntriesSize int
+
+	// NoLogsYetTimeout, if set, logs a debug message when the container hasn't
+	// logged anything after being connected to its log stream for this long.
+	NoLogsYetTimeout time.Duration
+
+	// StdoutHandler and StderrHandler, if set, receive the entries of the
+	// stdout and stderr log streams respectively instead of the entry
+	// handler of the target, e.g. to route them to different destinations.
+	StdoutHandler loki.EntryHandler
+	StderrHandler loki.EntryHandler
+
+	// BatchHandler, if set, receives the entries of the target in batches
+	// instead of the entry handler. A batch holds at most MaxBatchSize
+	// entries and must not be retained after the call returns.
+	BatchHandler func(entries []loki.Entry)
+	// MaxBatchSize is the maximum number of entries passed to BatchHandler at
+	// once. Defaults to 100 if zero or less.
+	MaxBatchSize int
+
+	// RequiredLabel, if set, defers reading logs until the container has the
+	// given label, e.g. when it's set after startup by an init process.
+	RequiredLabel string
+	// RequiredLabelTimeout is how long to wait for RequiredLabel before the
+	// target gives up and stops with an error. Zero waits forever.
+	RequiredLabelTimeout time.Duration
+	// AttachPollInterval is how often the container is inspected again while
+	// waiting for RequiredLabel, in addition to watching container events. It
+	// is also the initial delay before resubscribing to container events after
+	// the subscription failed. Defaults to 1s if zero or less.
+	AttachPollInterval time.Duration
+
+	// InspectRetries is the number of times inspecting the container before
+	// attaching to it is retried when it fails, e.g. in a race with the
+	// startup of the container, before the target stops with the error. The
+	// delay between retries doubles from InspectBackoff. Failures because the
+	// container doesn't exist aren't retried. Defaults to 3 retries if zero,
+	// and to no retries if negative; InspectBackoff defaults to 100ms if zero
+	// or less.
+	InspectRetries int
+	InspectBackoff time.Duration
+
+	// RefreshDebounce, if set, coalesces the container events arriving within
+	// this window after an event, so that rapidly firing events only cause
+	// the container to be inspected again once.
+	RefreshDebounce time.Duration
+
+	// MetaLabelFunc, if set, derives additional labels from the inspect
+	// information of the container whenever the target attaches to it. They
+	// are available to relabeling rules alongside the built-in meta labels,
+	// which take precedence over labels of the same name.
+	MetaLabelFunc func(info docker_types.ContainerJSON) model.LabelSet
+
+	// PlatformLabels adds the __meta_docker_container_os and
+	// __meta_docker_container_arch meta labels with the platform of the
+	// container, e.g. "linux" and "arm64/v8". The image of the container is
+	// inspected for it whenever the target attaches to the container.
+	PlatformLabels bool
+
+	// LabelTemplates sets labels, keyed by name, to the result of Go
+	// templates evaluated over the labels of the target before relabeling,
+	// e.g. {{ .__meta_docker_container_name }}. Label names which don't exist
+	// render as empty strings, and a template rendering to an empty string
+	// leaves the label unchanged.
+	LabelTemplates map[string]string
+
+	// MultilineFirstLine, if set, is a regular expression matching the first
+	// line of multiline entries, e.g. of stack traces. Lines which don't match
+	// it are appended to the current entry, which keeps the timestamp of its
+	// first line.
+	MultilineFirstLine string
+	// MultilineSeparator joins the lines of a multiline entry. Defaults to a
+	// newline if empty.
+	MultilineSeparator string
+	// MultilineMaxWait is how long an incomplete multiline entry is held back
+	// waiting for more lines. Defaults to 3s if zero or less.
+	MultilineMaxWait time.Duration
+	// MultilineMaxLines is the maximum number of lines of a multiline entry.
+	// Defaults to 128 if zero or less.
+	MultilineMaxLines int
+
+	// FollowRestarts keeps the target running once the log stream ends
+	// because the container stopped, and re-attaches to the container once
+	// it's started again. If the log stream ends while the container is
+	// still running, e.g. as the connection to the daemon was lost, the
+	// target re-attaches after AttachPollInterval instead.
+	FollowRestarts bool
+	// RestartLoopThreshold is the number of restarts within RestartLoopWindow
+	// after which re-attaching to the container is delayed, with a delay
+	// doubling from RestartBackoffMin up to RestartBackoffMax. Defaults to 5
+	// restarts within 1m, and a delay between 1s and 1m.
+	RestartLoopThreshold int
+	RestartLoopWindow    time.Duration
+	RestartBackoffMin    time.Duration
+	RestartBackoffMax    time.Duration
+
+	// DetachOnPause closes the log stream once the container is paused, as
+	// noticed through its pause events, and re-establishes it once the
+	// container is unpaused, rather than keeping the stalled log stream open.
+	// The target has the StatusContainerPaused status meanwhile.
+	DetachOnPause bool
+
+	// LabelsAsMetadata attaches a snapshot of the container's labels, taken
+	// when connecting to the log stream, to every entry as structured
+	// metadata. At most MetadataMaxLabels labels are attached, in order of
+	// their name, and their values are truncated to MetadataMaxValueLength
+	// bytes. Defaults to 32 labels and 256 bytes.
+	LabelsAsMetadata       bool
+	MetadataMaxLabels      int
+	MetadataMaxValueLength int
+
+	// ReconnectLimiter, if set, limits the rate at which log streams are
+	// re-established, including by targets replacing others for the same
+	// container. Only the first log stream opened for a container isn't
+	// limited.
+	ReconnectLimiter *ReconnectLimiter
+
+	// LabelRateLimiter, if set, drops the entries exceeding the rate limit of
+	// their value of the label it's keyed on. The label is looked up after
+	// relabeling.
+	LabelRateLimiter *LabelRateLimiter
+
+	// StripBOM strips a UTF-8 byte order mark from the beginning of lines,
+	// as written by some Windows applications at the start of their output.
+	StripBOM bool
+
+	// KeepTimestampPrefix keeps the timestamp Docker prefixes every line with
+	// in the line of the entry. By default, the prefix is removed, as it's
+	// already the timestamp of the entry. Joined and multiline entries keep
+	// the prefix of their first line. Truncation and level filtering look at
+	// the line without the prefix.
+	KeepTimestampPrefix bool
+
+	// MinLevel, if set, drops JSON lines whose level is below the given
+	// level, e.g. "warn" drops trace, debug and info lines. The level is read
+	// from the LevelField field, which defaults to "level". Lines which aren't
+	// JSON, or which don't have a known level, are kept.
+	MinLevel   string
+	LevelField string
+
+	// NullBytePolicy is how entries containing null bytes are handled:
+	// NullBytePolicyReplace replaces them with NullByteReplacement,
+	// NullBytePolicyStrip removes them, and NullBytePolicyDrop drops the
+	// entries. Defaults to replacing null bytes with U+FFFD, the Unicode
+	// replacement character.
+	NullBytePolicy      NullBytePolicy
+	NullByteReplacement string
+
+	// TruncationMarker, if set, marks entries ending with it as truncated, for
+	// logging setups which mark truncated lines.
+	TruncationMarker string
+
+	// TimestampSources is the order in which the timestamp of an entry is
+	// resolved; the first source which resolves is used. Lines for which no
+	// source resolves are skipped. Defaults to the Docker timestamp only. The
+	// position, deduplication and MaxLag are still based on the Docker
+	// timestamp, whichever source the timestamp of the entry is taken from.
+	TimestampSources []TimestampSource
+	// InlineTimestampExpression is a regular expression whose first capturing
+	// group matches the inline timestamp of a line, parsed with
+	// InlineTimestampLayout. Defaults to the first word of the line and
+	// RFC3339 with optional fractional seconds.
+	InlineTimestampExpression string
+	InlineTimestampLayout     string
+
+	// DebugWriter, if set, receives every entry handed over to the handler
+	// as a line of JSON with its labels, timestamp and line, e.g. to inspect
+	// the entries on stdout during development. Targets sharing a writer
+	// serialize their writes to it, unless it can't be compared, e.g. as it's
+	// a struct holding a slice, in which case it must be safe for concurrent
+	// use.
+	DebugWriter io.Writer
+
+	// MaxLag, if set, drops entries whose Docker timestamp is older than
+	// MaxLag when they're read, so that a target which fell behind, e.g. under
+	// sustained overload, skips the backlog to catch up with the most recent
+	// entries rather than falling further behind. The position advances past
+	// dropped entries, and log streams are read from MaxLag ago at the
+	// earliest, unless Tail applies.
+	MaxLag time.Duration
+
+	// Tail, if set, only reads the given number of most recent lines when
+	// the target has no position for the container yet. Once a position is
+	// known, the log stream is read from it, and Tail is ignored; the two are
+	// never combined, as Docker versions disagree on how to apply them.
+	Tail int
+
+	// AnnotateGeneration attaches the generation of the log stream to every
+	// entry as the reconnect_generation structured metadata. The generation
+	// starts at one and increases every time the log stream is established,
+	// e.g. to tell apart the entries read before and after a reconnect.
+	AnnotateGeneration bool
+	// AnnotateStartPosition attaches the timestamp in seconds the log stream
+	// was read from to every entry as the start_position structured metadata,
+	// e.g. to audit which entries were read again after a reconnect. It's the
+	// since parameter Docker was asked for, after applying MaxLag, or zero if
+	// the log stream was read from its beginning or with Tail.
+	AnnotateStartPosition bool
+
+	// MaxLifetime, if set, stops the target once it has been running for this
+	// long since it was first started, regardless of the state of the
+	// container. The target can't be started again afterwards.
+	MaxLifetime time.Duration
+	// OnStop, if set, is called once the target stopped by itself rather than
+	// through Stop or Pause, e.g. because its lifetime is over or the log
+	// stream ended, with the error the target failed with, if any. It's
+	// called from the goroutine of the target once it's marked as stopped.
+	OnStop func(err error)
+
+	// MaxReconnects, if set, stops the target with an error once the log
+	// stream was re-established more than MaxReconnects times within
+	// MaxReconnectsWindow, rather than reconnecting forever. Calls to
+	// Reconnect count, as does re-attaching to a restarted or unpaused
+	// container, to a container whose log stream ended while it kept running,
+	// or to a container matching the attach conditions again.
+	// OnStop is called with the error. The window defaults to 1m if zero or
+	// less.
+	MaxReconnects       int
+	MaxReconnectsWindow time.Duration
+
+	// PositionsSyncEntries, if set, has the positions file written in the
+	// background every time this many entries were handed over to the
+	// handler, in addition to the sync period of the positions file, so that
+	// busy containers lose fewer positions on a crash. It requires positions
+	// which implement positions.Syncer.
+	PositionsSyncEntries int
+}
+
+const (
+	// defaultMaxBatchSize is the maximum size of batches if
+	// Options.MaxBatchSize is unset.
+	defaultMaxBatchSize = 100
+	// defaultAttachPollInterval is how often a container is inspected while
+	// waiting for Options.RequiredLabel if Options.AttachPollInterval is
+	// unset.
+	defaultAttachPollInterval = time.Second
+)
+
+// hasAttachConditions reports whether the options restrict when the target
+// attaches to the container.
+func (o Options) hasAttachConditions() bool {
+	return o.NameGlob != "" || o.User != "" || o.HealthStatus != "" || o.RequiredLabel != "" || o.DetachOnPause
+}
+
+// watchesEvents reports whether the target needs to watch container events.
+func (o Options) watchesEvents() bool {
+	return o.hasAttachConditions() || o.FollowRestarts
+}
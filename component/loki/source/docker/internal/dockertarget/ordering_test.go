@@ -0,0 +1,106 @@
+package dockertarget
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grafana/agent/component/common/loki/client/fake"
+	"github.com/grafana/agent/component/loki/source/docker/internal/fakedocker"
+	"github.com/stretchr/testify/require"
+)
+
+// orderedFixture returns n lines of a container with strictly increasing
+// timestamps, several per second, so that reconnects resume in the middle of
+// a second.
+func orderedFixture(container string, start time.Time, n int) []string {
+	lines := make([]string, n)
+	for i := range lines {
+		ts := start.Add(time.Duration(i) * 7 * time.Millisecond)
+		lines[i] = fmt.Sprintf("%s %s line %d", ts.Format(time.RFC3339Nano), container, i)
+	}
+	return lines
+}
+
+// requireOrdered asserts that the handler received the lines of the fixture
+// exactly once each and in order, with monotonic timestamps.
+func requireOrdered(t *testing.T, container string, fixture []string, entryHandler *fake.Client) {
+	t.Helper()
+
+	received := entryHandler.Received()
+	require.Len(t, received, len(fixture), container)
+	for i, entry := range received {
+		ts, line, _ := strings.Cut(fixture[i], " ")
+		require.Equal(t, line, entry.Line, "%s: entry %d", container, i)
+		require.Equal(t, ts, entry.Timestamp.UTC().Format(time.RFC3339Nano), "%s: entry %d", container, i)
+		if i > 0 {
+			require.False(t, entry.Timestamp.Before(received[i-1].Timestamp), "%s: entry %d goes back in time", container, i)
+		}
+	}
+}
+
+// TestDockerTargetOrderingUnderLoad reads the logs of several containers
+// concurrently while more lines are logged and the log streams are
+// re-established over and over, and checks that every container's entries
+// arrive at the handler in order, without gaps or duplicates.
+func TestDockerTargetOrderingUnderLoad(t *testing.T) {
+	const (
+		containers = 8
+		lines      = 3000
+		chunks     = 10
+	)
+
+	d := fakedocker.New(t)
+	start := time.Date(2023, 12, 9, 9, 16, 57, 0, time.UTC)
+
+	var (
+		wg       sync.WaitGroup
+		fixtures = make([][]string, containers)
+		targets  = make([]*Target, containers)
+		handlers = make([]*fake.Client, containers)
+	)
+	for i := range fixtures {
+		id := fmt.Sprintf("c%d", i)
+		fixtures[i] = orderedFixture(id, start, lines)
+		d.AddContainer(id, "/"+id)
+		targets[i], handlers[i], _ = newTestTargetWithClient(t, d.Client(), id, Options{})
+	}
+
+	for i, tgt := range targets {
+		id := fmt.Sprintf("c%d", i)
+		tgt.StartIfNotRunning()
+		defer tgt.Stop()
+
+		// Lines are logged in chunks, and each chunk is only read once the
+		// log stream is re-established.
+		wg.Add(1)
+		go func(i int, tgt *Target) {
+			defer wg.Done()
+			chunk := lines / chunks
+			for c := 0; c < chunks; c++ {
+				d.AppendLines(id, fixtures[i][c*chunk:(c+1)*chunk]...)
+				for r := 0; r < 3; r++ {
+					tgt.Reconnect()
+					time.Sleep(time.Millisecond)
+				}
+			}
+		}(i, tgt)
+	}
+	wg.Wait()
+
+	// Keep reconnecting until the last chunk was read.
+	for i, tgt := range targets {
+		require.Eventually(t, func() bool {
+			if len(handlers[i].Received()) == lines {
+				return true
+			}
+			tgt.Reconnect()
+			return false
+		}, 20*time.Second, 50*time.Millisecond)
+	}
+	for i := range targets {
+		requireOrdered(t, fmt.Sprintf("c%d", i), fixtures[i], handlers[i])
+	}
+}
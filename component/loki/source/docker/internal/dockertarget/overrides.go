@@ -0,0 +1,104 @@
+package dockertarget
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"time"
+
+	docker_types "github.com/docker/docker/api/types"
+	"github.com/grafana/agent/pkg/flow/logging/level"
+)
+
+// Container labels which override the options of the target for a single
+// container. They are read whenever the target attaches to the container.
+const (
+	configLabelPrefix = "logging.agent/"
+
+	// configLabelMultilineFirstLine overrides Options.MultilineFirstLine.
+	configLabelMultilineFirstLine = configLabelPrefix + "multiline.firstline"
+	// configLabelMultilineMaxWait overrides Options.MultilineMaxWait, e.g.
+	// "5s".
+	configLabelMultilineMaxWait = configLabelPrefix + "multiline.max_wait"
+	// configLabelMultilineMaxLines overrides Options.MultilineMaxLines.
+	configLabelMultilineMaxLines = configLabelPrefix + "multiline.max_lines"
+	// configLabelStreams selects the log streams which are read: "stdout",
+	// "stderr", or "all".
+	configLabelStreams = configLabelPrefix + "streams"
+)
+
+var (
+	errNotPositive    = errors.New("must be positive")
+	errUnknownStreams = errors.New(`must be "stdout", "stderr" or "all"`)
+)
+
+// containerConfig is the configuration of the target for a container, after
+// applying the overrides of its labels.
+type containerConfig struct {
+	firstLine         *regexp.Regexp
+	multilineMaxWait  time.Duration
+	multilineMaxLines int
+	stdout, stderr    bool
+}
+
+// containerConfig returns the configuration for the container. Invalid
+// overrides are logged and ignored.
+func (t *Target) containerConfig(info docker_types.ContainerJSON) containerConfig {
+	cfg := containerConfig{
+		firstLine:         t.firstLine,
+		multilineMaxWait:  t.multilineMaxWait(),
+		multilineMaxLines: t.multilineMaxLines(),
+		stdout:            true,
+		stderr:            true,
+	}
+	if info.Config == nil {
+		return cfg
+	}
+
+	invalid := func(label, value string, err error) {
+		level.Warn(t.logger).Log("msg", "ignoring invalid configuration label", "container", t.containerName, "label", label, "value", value, "err", err)
+	}
+	for label, value := range info.Config.Labels {
+		switch label {
+		case configLabelMultilineFirstLine:
+			re, err := regexp.Compile(value)
+			if err != nil {
+				invalid(label, value, err)
+				continue
+			}
+			cfg.firstLine = re
+		case configLabelMultilineMaxWait:
+			d, err := time.ParseDuration(value)
+			if err == nil && d <= 0 {
+				err = errNotPositive
+			}
+			if err != nil {
+				invalid(label, value, err)
+				continue
+			}
+			cfg.multilineMaxWait = d
+		case configLabelMultilineMaxLines:
+			n, err := strconv.Atoi(value)
+			if err == nil && n <= 0 {
+				err = errNotPositive
+			}
+			if err != nil {
+				invalid(label, value, err)
+				continue
+			}
+			cfg.multilineMaxLines = n
+		case configLabelStreams:
+			switch value {
+			case "stdout":
+				cfg.stdout, cfg.stderr = true, false
+			case "stderr":
+				cfg.stdout, cfg.stderr = false, true
+			case "all":
+				cfg.stdout, cfg.stderr = true, true
+			default:
+				invalid(label, value, errUnknownStreams)
+			}
+		}
+	}
+	return cfg
+}
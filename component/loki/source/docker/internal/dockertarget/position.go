@@ -0,0 +1,118 @@
+package dockertarget
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/grafana/agent/component/common/loki/positions"
+)
+
+// readPosition returns the position of a container. Positions are keyed by
+// the full container ID, but may have been written under the short ID, e.g.
+// if the Docker daemon reported short IDs at the time. Such positions are
+// moved to the full ID, so that the target resumes where it left off.
+func readPosition(ps positions.Positions, containerID, labels string) (int64, error) {
+	pos, err := ps.Get(positions.CursorKey(containerID), labels)
+	if err != nil || pos != 0 {
+		return pos, err
+	}
+
+	shortID := truncateID(containerID)
+	if shortID == containerID {
+		return 0, nil
+	}
+	pos, err = ps.Get(positions.CursorKey(shortID), labels)
+	if err != nil || pos == 0 {
+		// The short ID may belong to something else; it's not an error for
+		// this container if its position can't be read.
+		return 0, nil
+	}
+	ps.Put(positions.CursorKey(containerID), labels, pos)
+	ps.Remove(positions.CursorKey(shortID), labels)
+	return pos, nil
+}
+
+// putPosition records the position of the container, in seconds.
+func (t *Target) putPosition(since int64) {
+	t.positions.Put(positions.CursorKey(t.containerName), t.labelsStr, since)
+}
+
+// maybeSyncPositions counts an entry handed over to the handler, and requests
+// the positions file to be written every Options.PositionsSyncEntries
+// entries. The file is written by the positions, so that entries aren't held
+// back while it's written.
+func (t *Target) maybeSyncPositions() {
+	n := uint64(t.opts.PositionsSyncEntries)
+	if n == 0 || t.unsynced.Inc()%n != 0 {
+		return
+	}
+	if syncer, ok := t.positions.(positions.Syncer); ok {
+		syncer.RequestSync()
+	}
+}
+
+// RemovePosition removes the position of the container, e.g. once the
+// container is gone.
+func (t *Target) RemovePosition() {
+	t.positions.Remove(positions.CursorKey(t.containerName), t.labelsStr)
+}
+
+// PositionsSaved updates the positions metrics from the positions written to
+// the positions file, as passed to positions.Config.OnSave. Only containers
+// with a running target have a series, set to the latest position of their
+// targets.
+func (m *Metrics) PositionsSaved(saved map[positions.Entry]string) {
+	m.flushedMut.Lock()
+	defer m.flushedMut.Unlock()
+
+	latest := make(map[string]int64, len(m.running))
+	for e, pos := range saved {
+		containerID, ok := strings.CutPrefix(e.Path, positions.CursorKey(""))
+		if !ok {
+			continue
+		}
+		if _, ok := m.running[containerID]; !ok {
+			continue
+		}
+		since, err := strconv.ParseInt(pos, 10, 64)
+		if err != nil {
+			continue
+		}
+		if prev, ok := latest[containerID]; !ok || since > prev {
+			latest[containerID] = since
+		}
+	}
+	for containerID := range m.running {
+		if since, ok := latest[containerID]; ok {
+			m.dockerLastFlushedPositionTimestamp.WithLabelValues(containerID).Set(float64(since))
+		} else {
+			m.dockerLastFlushedPositionTimestamp.DeleteLabelValues(containerID)
+		}
+	}
+}
+
+// targetStarted marks a target of the container as running, so that its
+// positions are exposed once written.
+func (m *Metrics) targetStarted(containerID string) {
+	m.flushedMut.Lock()
+	defer m.flushedMut.Unlock()
+
+	if m.running == nil {
+		m.running = make(map[string]int)
+	}
+	m.running[containerID]++
+}
+
+// targetStopped marks a target of the container as stopped. The series of the
+// container is deleted once none of its targets is running.
+func (m *Metrics) targetStopped(containerID string) {
+	m.flushedMut.Lock()
+	defer m.flushedMut.Unlock()
+
+	if m.running[containerID] > 1 {
+		m.running[containerID]--
+		return
+	}
+	delete(m.running, containerID)
+	m.dockerLastFlushedPositionTimestamp.DeleteLabelValues(containerID)
+}
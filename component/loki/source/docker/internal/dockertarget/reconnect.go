@@ -0,0 +1,61 @@
+package dockertarget
+
+import (
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// ReconnectLimiter limits the rate at which log streams are re-established.
+// It's meant to be shared by all targets of a source, so that they don't
+// reconnect all at once, e.g. after the Docker daemon restarted. It remembers
+// the containers a log stream was opened for, so that only the first log
+// stream opened for a container is exempt from the limit, even when the target
+// is replaced by a new one for the same container.
+type ReconnectLimiter struct {
+	limiter *rate.Limiter
+
+	mut    sync.Mutex
+	opened map[string]struct{}
+}
+
+// NewReconnectLimiter returns a ReconnectLimiter allowing limit reconnects per
+// second, with bursts of up to burst reconnects. burst must be at least one.
+func NewReconnectLimiter(limit rate.Limit, burst int) *ReconnectLimiter {
+	return &ReconnectLimiter{
+		limiter: rate.NewLimiter(limit, burst),
+		opened:  make(map[string]struct{}),
+	}
+}
+
+// SetLimits updates the rate and the burst of the limiter.
+func (l *ReconnectLimiter) SetLimits(limit rate.Limit, burst int) {
+	l.limiter.SetLimit(limit)
+	l.limiter.SetBurst(burst)
+}
+
+// Retain forgets the containers which aren't in containerIDs, e.g. as they
+// are gone, so that opening a log stream for them again isn't limited.
+func (l *ReconnectLimiter) Retain(containerIDs map[string]struct{}) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	for id := range l.opened {
+		if _, ok := containerIDs[id]; !ok {
+			delete(l.opened, id)
+		}
+	}
+}
+
+// reserve records that a log stream is opened for a container. It returns a
+// reservation to wait for, or nil if it's the first log stream of the
+// container.
+func (l *ReconnectLimiter) reserve(containerID string) *rate.Reservation {
+	l.mut.Lock()
+	_, ok := l.opened[containerID]
+	l.opened[containerID] = struct{}{}
+	l.mut.Unlock()
+	if !ok {
+		return nil
+	}
+	return l.limiter.Reserve()
+}
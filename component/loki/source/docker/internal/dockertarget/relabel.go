@@ -0,0 +1,75 @@
+package dockertarget
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/prometheus/prometheus/model/relabel"
+	"gopkg.in/yaml.v2"
+)
+
+// validateRelabelConfigs checks relabeling rules by round-tripping them
+// through YAML, so that invalid rules fail when the target is created rather
+// than when relabeling its entries, with the same checks as rules loaded from
+// YAML. Rules without a regular expression get the default one, as they would
+// when loaded from YAML; the returned rules are copies where needed and the
+// given ones are left unchanged.
+func validateRelabelConfigs(rcs []*relabel.Config) ([]*relabel.Config, error) {
+	if len(rcs) == 0 {
+		return rcs, nil
+	}
+	res := make([]*relabel.Config, len(rcs))
+	for i, rc := range rcs {
+		valid, err := validateRelabelConfig(rc)
+		if err != nil {
+			return nil, fmt.Errorf("invalid relabel config at index %d: %w", i, err)
+		}
+		res[i] = valid
+	}
+	return res, nil
+}
+
+func validateRelabelConfig(rc *relabel.Config) (*relabel.Config, error) {
+	if rc == nil {
+		return nil, errors.New("relabel config cannot be nil")
+	}
+	// An empty action would be omitted from the YAML and silently default to
+	// replace.
+	if rc.Action == "" {
+		return nil, errors.New("relabel action cannot be empty")
+	}
+	if rc.Regex.Regexp == nil {
+		defaulted := *rc
+		defaulted.Regex = relabel.DefaultRelabelConfig.Regex
+		rc = &defaulted
+	}
+
+	out, err := yaml.Marshal(rc)
+	if err != nil {
+		return nil, err
+	}
+	// Rules from Flow have every field set to its default. The checks of
+	// keepequal and dropequal rules compare the regex with the default one by
+	// identity, so the default regex is removed from the YAML to be unmarshaled
+	// as the default itself.
+	if rc.Regex.String() == relabel.DefaultRelabelConfig.Regex.String() {
+		var fields yaml.MapSlice
+		if err := yaml.Unmarshal(out, &fields); err != nil {
+			return nil, err
+		}
+		for i, field := range fields {
+			if field.Key == "regex" {
+				fields = append(fields[:i], fields[i+1:]...)
+				break
+			}
+		}
+		if out, err = yaml.Marshal(fields); err != nil {
+			return nil, err
+		}
+	}
+	var parsed relabel.Config
+	if err := yaml.UnmarshalStrict(out, &parsed); err != nil {
+		return nil, err
+	}
+	return rc, nil
+}
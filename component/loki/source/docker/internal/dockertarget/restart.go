@@ -0,0 +1,97 @@
+package dockertarget
+
+import (
+	"time"
+
+	docker_types "github.com/docker/docker/api/types"
+)
+
+const (
+	// defaultRestartLoopThreshold is the number of restarts within the restart
+	// loop window tolerated if Options.RestartLoopThreshold is unset.
+	defaultRestartLoopThreshold = 5
+	// defaultRestartLoopWindow is the window restarts are counted in if
+	// Options.RestartLoopWindow is unset.
+	defaultRestartLoopWindow = time.Minute
+	// defaultRestartBackoffMin and defaultRestartBackoffMax bound the delay
+	// of re-attaching to a container in a restart loop if
+	// Options.RestartBackoffMin or Options.RestartBackoffMax are unset.
+	defaultRestartBackoffMin = time.Second
+	defaultRestartBackoffMax = time.Minute
+)
+
+// restartTracker detects restart loops of a container from the times the
+// target re-attached to it, and computes an increasing delay for re-attaching
+// while the loop lasts.
+type restartTracker struct {
+	threshold  int
+	window     time.Duration
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	restarts []time.Time
+	backoff  time.Duration
+}
+
+func newRestartTracker(opts Options) *restartTracker {
+	r := &restartTracker{
+		threshold:  opts.RestartLoopThreshold,
+		window:     opts.RestartLoopWindow,
+		minBackoff: opts.RestartBackoffMin,
+		maxBackoff: opts.RestartBackoffMax,
+	}
+	if r.threshold <= 0 {
+		r.threshold = defaultRestartLoopThreshold
+	}
+	if r.window <= 0 {
+		r.window = defaultRestartLoopWindow
+	}
+	if r.minBackoff <= 0 {
+		r.minBackoff = defaultRestartBackoffMin
+	}
+	if r.maxBackoff <= 0 {
+		r.maxBackoff = defaultRestartBackoffMax
+	}
+	return r
+}
+
+// Restarted records a restart of the container at now and returns how long
+// to wait before re-attaching to it. The delay doubles with every restart
+// beyond the threshold, and is reset once the container restarts less often.
+func (r *restartTracker) Restarted(now time.Time) time.Duration {
+	keep := r.restarts[:0]
+	for _, ts := range r.restarts {
+		if now.Sub(ts) < r.window {
+			keep = append(keep, ts)
+		}
+	}
+	r.restarts = append(keep, now)
+
+	if len(r.restarts) <= r.threshold {
+		r.backoff = 0
+		return 0
+	}
+	if r.backoff == 0 {
+		r.backoff = r.minBackoff
+	} else {
+		r.backoff *= 2
+	}
+	if r.backoff > r.maxBackoff {
+		r.backoff = r.maxBackoff
+	}
+	return r.backoff
+}
+
+// startedAt returns when the container was last started, which changes with
+// every restart.
+func startedAt(info docker_types.ContainerJSON) string {
+	if info.ContainerJSONBase == nil || info.State == nil {
+		return ""
+	}
+	return info.State.StartedAt
+}
+
+// isRunning reports whether the container is running.
+func isRunning(info docker_types.ContainerJSON) bool {
+	return info.ContainerJSONBase != nil && info.State != nil && info.State.Running
+}
@@ -0,0 +1,62 @@
+package dockertarget
+
+import (
+	"sync"
+
+	"github.com/grafana/agent/component/common/loki"
+)
+
+// defaultRecentEntriesSize is the number of recent entries kept by a target
+// if Options.RecentEntriesSize is unset.
+const defaultRecentEntriesSize = 10
+
+// entryRing is a fixed-size ring buffer of the most recent entries.
+type entryRing struct {
+	mut  sync.Mutex
+	buf  []loki.Entry
+	next int
+	full bool
+}
+
+func newEntryRing(size int) *entryRing {
+	return &entryRing{buf: make([]loki.Entry, size)}
+}
+
+// Add adds an entry, overwriting the oldest one if the buffer is full.
+func (r *entryRing) Add(e loki.Entry) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	r.buf[r.next] = e
+	r.next = (r.next + 1) % len(r.buf)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// Last returns up to n of the most recent entries, from oldest to newest.
+func (r *entryRing) Last(n int) []loki.Entry {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	size := r.next
+	if r.full {
+		size = len(r.buf)
+	}
+	if n > size {
+		n = size
+	}
+	if n <= 0 {
+		return nil
+	}
+
+	res := make([]loki.Entry, 0, n)
+	start := r.next - n
+	if start < 0 {
+		start += len(r.buf)
+	}
+	for i := 0; i < n; i++ {
+		res = append(res, r.buf[(start+i)%len(r.buf)])
+	}
+	return res
+}
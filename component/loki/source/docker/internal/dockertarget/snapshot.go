@@ -0,0 +1,46 @@
+package dockertarget
+
+import "go.uber.org/atomic"
+
+// MetricsSnapshot holds the counts of a single target. The Prometheus
+// metrics of the same name are shared by all targets of a source.
+type MetricsSnapshot struct {
+	// Read is the number of entries handed over to the handler.
+	Read uint64
+	// Dropped is the number of entries dropped because their ingestion lag
+	// exceeded Options.MaxLag, because their level was below
+	// Options.MinLevel, because of Options.NullBytePolicy, or by
+	// Options.LabelRateLimiter.
+	Dropped uint64
+	// Deduplicated is the number of lines read again after the log stream
+	// was re-established which were skipped as already sent.
+	Deduplicated uint64
+	// Errors is the number of lines which couldn't be read or parsed.
+	Errors uint64
+	// Reconnects is the number of times the log stream was re-established.
+	Reconnects uint64
+	// Truncated is the number of entries detected to be truncated.
+	Truncated uint64
+}
+
+// targetCounters counts the events of a target in addition to Metrics.
+type targetCounters struct {
+	read         atomic.Uint64
+	dropped      atomic.Uint64
+	deduplicated atomic.Uint64
+	errors       atomic.Uint64
+	reconnects   atomic.Uint64
+	truncated    atomic.Uint64
+}
+
+// MetricsSnapshot returns the counts of the target since it was created.
+func (t *Target) MetricsSnapshot() MetricsSnapshot {
+	return MetricsSnapshot{
+		Read:         t.counters.read.Load(),
+		Dropped:      t.counters.dropped.Load(),
+		Deduplicated: t.counters.deduplicated.Load(),
+		Errors:       t.counters.errors.Load(),
+		Reconnects:   t.counters.reconnects.Load(),
+		Truncated:    t.counters.truncated.Load(),
+	}
+}
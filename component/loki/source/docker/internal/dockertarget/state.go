@@ -0,0 +1,77 @@
+package dockertarget
+
+import (
+	"fmt"
+
+	"github.com/grafana/agent/component/common/loki"
+)
+
+// State is the runtime state of a Target which isn't kept in the positions
+// file. It can be carried over to a new Target for the same container, for
+// example when the target is recreated on a reload, so that the new Target
+// continues where the previous one stopped.
+type State struct {
+	// Since is the timestamp in seconds the log stream is resumed from. It is
+	// kept in the positions file as well, but under the labels of the target
+	// which exported the state.
+	Since int64 `json:"since"`
+
+	// DedupSecond and DedupEntries describe the entries which were already
+	// sent for the second the log stream is resumed from, so that they aren't
+	// sent twice.
+	DedupSecond  int64          `json:"dedup_second"`
+	DedupEntries map[uint64]int `json:"dedup_entries,omitempty"`
+
+	RecentEntries   []loki.Entry `json:"recent_entries,omitempty"`
+	ReconnectReason string       `json:"reconnect_reason,omitempty"`
+
+	// Generation is the number of times the log stream was established, so
+	// that generations keep increasing across targets.
+	Generation uint64 `json:"generation,omitempty"`
+}
+
+// ExportState returns the current runtime state of the target. It is safe to
+// call while the target is running, although the state is only complete once
+// the target is stopped.
+func (t *Target) ExportState() State {
+	second, counts := t.dedup.state()
+
+	t.mut.Lock()
+	reconnectReason := t.reconnectReason
+	t.mut.Unlock()
+
+	return State{
+		Since:           t.since.Load(),
+		DedupSecond:     second,
+		DedupEntries:    counts,
+		RecentEntries:   t.recent.Last(len(t.recent.buf)),
+		ReconnectReason: reconnectReason,
+		Generation:      t.generation.Load(),
+	}
+}
+
+// RestoreState restores state exported from another target for the same
+// container. It must be called before the target is started. A position
+// which is older than the one of the target is ignored.
+func (t *Target) RestoreState(s State) error {
+	if t.running.Load() {
+		return fmt.Errorf("cannot restore the state of running target %s", t.containerName)
+	}
+
+	if s.Since >= t.since.Load() {
+		t.since.Store(s.Since)
+		t.putPosition(s.Since)
+		t.dedup.restore(s.DedupSecond, s.DedupEntries)
+	}
+	if s.Generation > t.generation.Load() {
+		t.generation.Store(s.Generation)
+	}
+	for _, e := range s.RecentEntries {
+		t.recent.Add(e)
+	}
+
+	t.mut.Lock()
+	t.reconnectReason = s.ReconnectReason
+	t.mut.Unlock()
+	return nil
+}
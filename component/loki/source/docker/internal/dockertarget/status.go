@@ -0,0 +1,35 @@
+package dockertarget
+
+// Status describes what a Target is currently doing.
+type Status string
+
+// Possible statuses of a Target.
+const (
+	// StatusStopped means that the target isn't reading logs.
+	StatusStopped Status = "stopped"
+	// StatusConnecting means that the target is connecting to the log stream
+	// of the container.
+	StatusConnecting Status = "connecting"
+	// StatusWaiting means that the container doesn't match the attach
+	// conditions of the target yet.
+	StatusWaiting Status = "waiting"
+	// StatusAwaitingFirstLine means that the target is connected to the log
+	// stream, but the container hasn't logged anything since.
+	StatusAwaitingFirstLine Status = "awaiting_first_line"
+	// StatusReading means that the target is reading log lines.
+	StatusReading Status = "reading"
+	// StatusPaused means that reading logs was paused with Target.Pause.
+	StatusPaused Status = "paused"
+	// StatusContainerPaused means that the container is paused, and the
+	// target waits for it to be unpaused, see Options.DetachOnPause.
+	StatusContainerPaused Status = "container_paused"
+)
+
+// Status returns the current status of the target.
+func (t *Target) Status() Status {
+	return Status(t.status.Load())
+}
+
+func (t *Target) setStatus(s Status) {
+	t.status.Store(string(s))
+}
@@ -5,10 +5,11 @@ package dockertarget
 // read logs from Docker containers and forward them to other loki components.
 
 import (
-	"bufio"
 	"context"
 	"fmt"
 	"io"
+	"path"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
@@ -35,29 +36,106 @@ const (
 	dockerLabelLogStream       = dockerLabelContainerPrefix + "log_stream"
 )
 
+// Reasons recorded when the target re-establishes its log stream.
+const (
+	reconnectReasonManual = "manual"
+	// reconnectReasonRestart is recorded when Options.FollowRestarts
+	// re-attaches to a restarted container.
+	reconnectReasonRestart = "restart"
+	// reconnectReasonAttachConditions is recorded when re-attaching to a
+	// container which matches the attach conditions again.
+	reconnectReasonAttachConditions = "attach_conditions"
+	// reconnectReasonStreamEnded is recorded when Options.FollowRestarts
+	// re-attaches to a container whose log stream ended while it kept
+	// running.
+	reconnectReasonStreamEnded = "stream_ended"
+	// reconnectReasonUnpause is recorded when Options.DetachOnPause
+	// re-attaches to an unpaused container.
+	reconnectReasonUnpause = "unpause"
+)
+
 // Target enables reading Docker container logs.
 type Target struct {
 	logger        log.Logger
 	handler       loki.EntryHandler
-	since         int64
+	since         *atomic.Int64
 	positions     positions.Positions
 	containerName string
 	labels        model.LabelSet
 	labelsStr     string
 	relabelConfig []*relabel.Config
 	metrics       *Metrics
+	counters      targetCounters
+	opts          Options
+	templates     []labelTemplate
+	firstLine     *regexp.Regexp
+	timestamps    *timestampResolver
+	levels        *levelFilter
+	nullBytes     *nullByteFilter
+
+	mut             sync.Mutex // protects cancel, reconnectReason, deadline and reconnects
+	cancel          context.CancelCauseFunc
+	reconnectReason string
+	deadline        time.Time   // end of the lifetime of the target, if limited
+	reconnects      []time.Time // times of recent reconnects, if limited
+
+	recent *entryRing
+	dedup  *dedupWindow
+	debug  *debugTee
 
-	cancel  context.CancelFunc
 	client  client.APIClient
 	wg      sync.WaitGroup
 	running *atomic.Bool
+	paused  *atomic.Bool
+	status  *atomic.String
 	err     error
+
+	// startOnResume is set if the target is to be started once it's resumed.
+	startOnResume *atomic.Bool
+	// generation counts the times the log stream was opened.
+	generation *atomic.Uint64
+	// unsynced counts the entries sent, for Options.PositionsSyncEntries.
+	unsynced *atomic.Uint64
+	// healthChanged is the Unix time the container last changed to
+	// Options.HealthStatus, until the target attached because of it.
+	healthChanged *atomic.Int64
 }
 
 // NewTarget starts a new target to read logs from a given container ID.
-func NewTarget(metrics *Metrics, logger log.Logger, handler loki.EntryHandler, position positions.Positions, containerID string, labels model.LabelSet, relabelConfig []*relabel.Config, client client.APIClient) (*Target, error) {
+func NewTarget(metrics *Metrics, logger log.Logger, handler loki.EntryHandler, position positions.Positions, containerID string, labels model.LabelSet, relabelConfig []*relabel.Config, client client.APIClient, opts Options) (*Target, error) {
+	if _, err := path.Match(opts.NameGlob, ""); err != nil {
+		return nil, fmt.Errorf("invalid container name glob %q: %w", opts.NameGlob, err)
+	}
+	relabelConfig, err := validateRelabelConfigs(relabelConfig)
+	if err != nil {
+		return nil, err
+	}
+	templates, err := parseLabelTemplates(opts.LabelTemplates)
+	if err != nil {
+		return nil, err
+	}
+	var firstLine *regexp.Regexp
+	if opts.MultilineFirstLine != "" {
+		firstLine, err = regexp.Compile(opts.MultilineFirstLine)
+		if err != nil {
+			return nil, fmt.Errorf("invalid multiline first line expression %q: %w", opts.MultilineFirstLine, err)
+		}
+	}
+	timestamps, err := newTimestampResolver(opts)
+	if err != nil {
+		return nil, err
+	}
+	levels, err := newLevelFilter(opts)
+	if err != nil {
+		return nil, err
+	}
+	nullBytes, err := newNullByteFilter(opts)
+	if err != nil {
+		return nil, err
+	}
+
 	labelsStr := labels.String()
-	pos, err := position.Get(positions.CursorKey(containerID), labelsStr)
+	pos, err := readPosition(position, containerID, labelsStr)
 	if err != nil {
 		return nil, err
 	}
@@ -65,20 +143,40 @@ func NewTarget(metrics *Metrics, logger log.Logger, handler loki.EntryHandler, p
 	if pos != 0 {
 		since = pos
 	}
+	recentSize := opts.RecentEntriesSize
+	if recentSize <= 0 {
+		recentSize = defaultRecentEntriesSize
+	}
 
 	t := &Target{
 		logger:        logger,
 		handler:       handler,
-		since:         since,
+		since:         atomic.NewInt64(since),
 		positions:     position,
 		containerName: containerID,
 		labels:        labels,
 		labelsStr:     labelsStr,
 		relabelConfig: relabelConfig,
 		metrics:       metrics,
+		opts:          opts,
+		templates:     templates,
+		firstLine:     firstLine,
+		timestamps:    timestamps,
+		levels:        levels,
+		nullBytes:     nullBytes,
+		recent:        newEntryRing(recentSize),
+		dedup:         newDedupWindow(),
+		debug:         newDebugTee(opts.DebugWriter),
 
 		client:  client,
 		running: atomic.NewBool(false),
+		paused:  atomic.NewBool(false),
+		status:  atomic.NewString(string(StatusStopped)),
+
+		startOnResume: atomic.NewBool(false),
+		generation:    atomic.NewUint64(0),
+		unsynced:      atomic.NewUint64(0),
+		healthChanged: atomic.NewInt64(0),
 	}
 
 	// NOTE (@tpaschalis) The original Promtail implementation would call
@@ -88,24 +186,237 @@ func NewTarget(metrics *Metrics, logger log.Logger, handler loki.EntryHandler, p
 }
 
 func (t *Target) processLoop(ctx context.Context) {
-	t.running.Store(true)
+	// The deferred calls run in reverse order, so that the target is already
+	// marked as not running once a call to Stop returns.
+	defer t.stopped(ctx)
+	defer t.wg.Done()
 	defer t.running.Store(false)
+	defer t.setStatus(StatusStopped)
+	t.metrics.targetStarted(t.containerName)
+	defer t.metrics.targetStopped(t.containerName)
 
-	t.wg.Add(1)
-	defer t.wg.Done()
+	// Container events are only needed to re-evaluate the attach conditions
+	// and to notice restarts.
+	var refresh <-chan struct{}
+	if t.opts.watchesEvents() {
+		refresh = t.watchEvents(ctx)
+	}
+
+	// Labels can't be observed through events, so the container is polled
+	// while waiting for the required label.
+	var labelWaitStart time.Time
+
+	// When following restarts, the start time of the container the last log
+	// stream was read from tells whether the container was restarted since.
+	var (
+		awaitingRestart bool
+		lastStartedAt   string
+		restarts        = newRestartTracker(t.opts)
+	)
+
+	// reattachReason is set once the log stream ended or was detached from,
+	// so that attaching to the container again counts as a reconnect.
+	var reattachReason string
+
+	for {
+		t.setStatus(StatusConnecting)
+		inspectInfo, err := t.inspect(ctx)
+		if err != nil {
+			level.Error(t.logger).Log("msg", "could not inspect container info", "container", t.containerName, "err", err)
+			t.err = err
+			return
+		}
+
+		if !t.shouldAttach(inspectInfo) {
+			if t.pausedDetach(inspectInfo) {
+				level.Debug(t.logger).Log("msg", "container is paused, waiting for it to be unpaused", "container", t.containerName)
+				t.setStatus(StatusContainerPaused)
+			} else {
+				level.Debug(t.logger).Log("msg", "container does not match the attach conditions, waiting for changes", "container", t.containerName)
+				t.setStatus(StatusWaiting)
+			}
+
+			var poll <-chan time.Time
+			if t.opts.RequiredLabel != "" && !hasLabel(inspectInfo, t.opts.RequiredLabel) {
+				if labelWaitStart.IsZero() {
+					labelWaitStart = time.Now()
+				}
+				if timeout := t.opts.RequiredLabelTimeout; timeout > 0 && time.Since(labelWaitStart) >= timeout {
+					t.err = fmt.Errorf("container did not get the required label %q within %s", t.opts.RequiredLabel, timeout)
+					level.Error(t.logger).Log("msg", "giving up waiting for the required label", "container", t.containerName, "err", t.err)
+					return
+				}
+				poll = time.After(t.attachPollInterval())
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-refresh:
+			case <-poll:
+			}
+			continue
+		}
+		labelWaitStart = time.Time{}
+
+		if awaitingRestart {
+			if startedAt(inspectInfo) == lastStartedAt && isRunning(inspectInfo) {
+				// The log stream ended while the container kept running, e.g. as
+				// the connection to the daemon was lost, so it's re-established
+				// from the position after a delay.
+				level.Warn(t.logger).Log("msg", "log stream ended while the container is running, re-attaching", "container", t.containerName)
+				awaitingRestart = false
+				reattachReason = reconnectReasonStreamEnded
+				t.setStatus(StatusWaiting)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(t.attachPollInterval()):
+				}
+				continue
+			}
+			if startedAt(inspectInfo) == lastStartedAt {
+				t.setStatus(StatusWaiting)
+				select {
+				case <-ctx.Done():
+					return
+				case <-refresh:
+				case <-time.After(t.attachPollInterval()):
+				}
+				continue
+			}
+			awaitingRestart = false
 
+			if delay := restarts.Restarted(time.Now()); delay > 0 {
+				level.Warn(t.logger).Log("msg", "container is restarting in a loop, delaying re-attaching to it", "container", t.containerName, "delay", delay)
+				t.metrics.dockerRestartThrottled.Inc()
+				t.setStatus(StatusWaiting)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(delay):
+				}
+				continue
+			}
+		}
+
+		if reattachReason != "" {
+			if err := t.countReconnect(reattachReason); err != nil {
+				t.err = err
+				return
+			}
+			reattachReason = ""
+		}
+		if !t.waitReconnect(ctx) {
+			return
+		}
+		// Attaching because the container changed to the health status
+		// resumes from the change, as older logs predate it.
+		if changed := t.healthChanged.Swap(0); changed > t.since.Load() {
+			t.since.Store(changed)
+		}
+
+		streamCtx, cancel := context.WithCancel(ctx)
+		// detached is set to the reason to record when re-attaching, once the
+		// log stream is closed as the container no longer matches the attach
+		// conditions.
+		detached := atomic.NewString("")
+		watchDone := make(chan struct{})
+		go func() {
+			defer close(watchDone)
+			for {
+				select {
+				case <-streamCtx.Done():
+					return
+				case <-refresh:
+					info, err := t.client.ContainerInspect(streamCtx, t.containerName)
+					if err == nil && !t.shouldAttach(info) {
+						if t.pausedDetach(info) {
+							detached.Store(reconnectReasonUnpause)
+						} else {
+							detached.Store(reconnectReasonAttachConditions)
+						}
+						cancel()
+						return
+					}
+				}
+			}
+		}()
+
+		t.stream(streamCtx, inspectInfo)
+		cancel()
+		<-watchDone
+
+		// The target was stopped or the stream was exhausted.
+		reattachReason = detached.Load()
+		if reattachReason == "" {
+			if !t.opts.FollowRestarts || ctx.Err() != nil {
+				return
+			}
+			level.Debug(t.logger).Log("msg", "log stream ended, waiting for the container to restart", "container", t.containerName)
+			awaitingRestart = true
+			lastStartedAt = startedAt(inspectInfo)
+			reattachReason = reconnectReasonRestart
+			continue
+		}
+		if reattachReason == reconnectReasonUnpause {
+			level.Info(t.logger).Log("msg", "container was paused, detached", "container", t.containerName)
+		} else {
+			level.Info(t.logger).Log("msg", "container no longer matches the attach conditions, detached", "container", t.containerName)
+		}
+	}
+}
+
+// waitReconnect waits for Options.ReconnectLimiter before the log stream is
+// re-established. It returns false if ctx was canceled while waiting.
+func (t *Target) waitReconnect(ctx context.Context) bool {
+	if t.opts.ReconnectLimiter == nil {
+		return true
+	}
+	r := t.opts.ReconnectLimiter.reserve(t.containerName)
+	if r == nil || !r.OK() || r.Delay() == 0 {
+		return true
+	}
+
+	delay := r.Delay()
+	level.Debug(t.logger).Log("msg", "delaying reconnect to Docker log stream because of the reconnect rate limit", "container", t.containerName, "delay", delay)
+	t.metrics.dockerReconnectsThrottled.Inc()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		r.Cancel()
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func (t *Target) attachPollInterval() time.Duration {
+	if t.opts.AttachPollInterval <= 0 {
+		return defaultAttachPollInterval
+	}
+	return t.opts.AttachPollInterval
+}
+
+// stream reads the logs of the container until ctx is canceled or the log
+// stream is exhausted.
+func (t *Target) stream(ctx context.Context, inspectInfo docker_types.ContainerJSON) {
+	since := t.since.Load()
+	if t.opts.MaxLag > 0 && (since > 0 || t.opts.Tail == 0) {
+		// Entries older than MaxLag would be dropped anyway, so they aren't
+		// read in the first place.
+		since = max(since, time.Now().Add(-t.opts.MaxLag).Unix())
+	}
 	opts := docker_types.ContainerLogsOptions{
 		ShowStdout: true,
 		ShowStderr: true,
 		Follow:     true,
 		Timestamps: true,
-		Since:      strconv.FormatInt(t.since, 10),
+		Since:      strconv.FormatInt(since, 10),
 	}
-	inspectInfo, err := t.client.ContainerInspect(ctx, t.containerName)
-	if err != nil {
-		level.Error(t.logger).Log("msg", "could not inspect container info", "container", t.containerName, "err", err)
-		t.err = err
-		return
+	if since == 0 && t.opts.Tail > 0 {
+		opts.Tail = strconv.Itoa(t.opts.Tail)
 	}
 	logs, err := t.client.ContainerLogs(ctx, t.containerName, opts)
 	if err != nil {
@@ -113,24 +424,53 @@ func (t *Target) processLoop(ctx context.Context) {
 		t.err = err
 		return
 	}
+	t.setStatus(StatusAwaitingFirstLine)
+	if timeout := t.opts.NoLogsYetTimeout; timeout > 0 {
+		go func() {
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			select {
+			case <-ctx.Done():
+			case <-timer.C:
+				if t.Status() == StatusAwaitingFirstLine {
+					level.Debug(t.logger).Log("msg", "connected to the log stream, but the container hasn't logged anything yet", "container", t.containerName, "waited", timeout)
+				}
+			}
+		}()
+	}
 
-	// Start transferring
-	rstdout, wstdout := io.Pipe()
-	rstderr, wstderr := io.Pipe()
+	// Start transferring. The lines of both log streams are received in the
+	// order they were written in, and log streams which aren't selected for
+	// the container are discarded.
+	cfg := t.containerConfig(inspectInfo)
+	lines := make(chan streamLine, t.batchSize())
+	wstdout := newLineWriter(ctx, "stdout", lines)
+	wstderr := newLineWriter(ctx, "stderr", lines)
+	var stdout, stderr io.Writer = wstdout, wstderr
+	if !cfg.stdout {
+		stdout = io.Discard
+	}
+	if !cfg.stderr {
+		stderr = io.Discard
+	}
 	t.wg.Add(1)
 	go func() {
 		defer func() {
+			close(lines)
 			t.wg.Done()
-			wstdout.Close()
-			wstderr.Close()
-			t.Stop()
 		}()
 		var written int64
 		var err error
 		if inspectInfo.Config.Tty {
-			written, err = io.Copy(wstdout, logs)
+			written, err = io.Copy(stdout, logs)
 		} else {
-			written, err = stdcopy.StdCopy(wstdout, wstderr, logs)
+			written, err = stdcopy.StdCopy(stdout, stderr, logs)
+		}
+		if err == nil {
+			err = wstdout.Flush()
+		}
+		if err == nil {
+			err = wstderr.Flush()
 		}
 		if err != nil {
 			level.Warn(t.logger).Log("msg", "could not transfer logs", "written", written, "container", t.containerName, "err", err)
@@ -140,16 +480,60 @@ func (t *Target) processLoop(ctx context.Context) {
 	}()
 
 	// Start processing
-	t.wg.Add(2)
-	go t.process(rstdout, t.getStreamLabels("stdout"))
-	go t.process(rstderr, t.getStreamLabels("stderr"))
+	meta := inspectLabels(inspectInfo)
+	if t.opts.PlatformLabels {
+		for name, value := range t.platformLabels(ctx, inspectInfo) {
+			meta[name] = value
+		}
+	}
+	if t.opts.MetaLabelFunc != nil {
+		// Derived labels don't replace the built-in ones.
+		for name, value := range t.opts.MetaLabelFunc(inspectInfo) {
+			if _, ok := meta[name]; !ok {
+				meta[name] = value
+			}
+		}
+	}
+	metadata := t.labelsMetadata(inspectInfo)
+	if generation := t.generation.Inc(); t.opts.AnnotateGeneration {
+		metadata = append(metadata, logproto.LabelAdapter{
+			Name:  metadataReconnectGeneration,
+			Value: strconv.FormatUint(generation, 10),
+		})
+	}
+	if t.opts.AnnotateStartPosition {
+		metadata = append(metadata, logproto.LabelAdapter{
+			Name:  metadataStartPosition,
+			Value: strconv.FormatInt(since, 10),
+		})
+	}
+	replay := t.dedup.Replay(since)
+	streams := []*streamState{
+		t.newStreamState(t.newLogStream("stdout", cfg, meta, metadata, replay)),
+		t.newStreamState(t.newLogStream("stderr", cfg, meta, metadata, replay)),
+	}
+	finished := make(chan struct{})
+	t.wg.Add(1)
+	go func() {
+		defer close(finished)
+		t.process(ctx, lines, streams)
+	}()
 
-	// Wait until done
-	<-ctx.Done()
+	// Wait until either the target is stopped or the stream is exhausted.
+	select {
+	case <-ctx.Done():
+	case <-finished:
+	}
 	logs.Close()
 	level.Debug(t.logger).Log("msg", "done processing Docker logs", "container", t.containerName)
 }
 
+// utf8BOM is the UTF-8 encoded byte order mark.
+const utf8BOM = "\ufeff"
+
+// dockerTimestampLayout is the layout of the timestamps prefixed to log lines.
+const dockerTimestampLayout = "2006-01-02T15:04:05.999999999Z07:00"
+
 // extractTs tries for read the timestamp from the beginning of the log line.
 // It's expected to follow the format 2006-01-02T15:04:05.999999999Z07:00.
 func extractTs(line string) (time.Time, string, error) {
@@ -157,60 +541,417 @@ func extractTs(line string) (time.Time, string, error) {
 	if len(pair) != 2 {
 		return time.Now(), line, fmt.Errorf("Could not find timestamp in '%s'", line)
 	}
-	ts, err := time.Parse("2006-01-02T15:04:05.999999999Z07:00", pair[0])
+	ts, err := time.Parse(dockerTimestampLayout, pair[0])
 	if err != nil {
 		return time.Now(), line, fmt.Errorf("Could not parse timestamp from '%s': %w", pair[0], err)
 	}
 	return ts, pair[1], nil
 }
 
-// https://devmarkpro.com/working-big-files-golang
-func readLine(r *bufio.Reader) (string, error) {
-	var (
-		isPrefix = true
-		err      error
-		line, ln []byte
-	)
+// logStream describes one of the log streams of a container.
+type logStream struct {
+	name            string // stdout or stderr
+	labels          model.LabelSet
+	truncatedLabels model.LabelSet // labels of entries detected to be truncated
+	metadata        []logproto.LabelAdapter
+	replay          *dedupReplay
+	config          containerConfig
+}
+
+func (t *Target) newLogStream(name string, config containerConfig, meta model.LabelSet, metadata []logproto.LabelAdapter, replay *dedupReplay) logStream {
+	truncatedMeta := meta.Clone()
+	truncatedMeta[dockerLabelLineTruncated] = "true"
+	return logStream{
+		name:            name,
+		labels:          t.getStreamLabels(name, meta),
+		truncatedLabels: t.getStreamLabels(name, truncatedMeta),
+		metadata:        metadata,
+		replay:          replay,
+		config:          config,
+	}
+}
+
+// streamState is the state of processing one of the log streams.
+type streamState struct {
+	logStream
+	joiner    *continuationJoiner
+	multiline *multilineAggregator
+	// deadline is when the entries held back by joiner and multiline are
+	// flushed, unless more lines of the log stream arrive before.
+	deadline time.Time
+}
+
+// pending reports whether the log stream holds back an incomplete entry.
+func (s *streamState) pending() bool {
+	_, joining := s.joiner.Held()
+	return joining || s.multiline.Pending()
+}
+
+// held returns the Docker timestamp of the oldest entry the log stream
+// holds back, if any.
+func (s *streamState) held() (time.Time, bool) {
+	var held time.Time
+	for _, h := range []func() (lineStamp, bool){s.multiline.Held, s.joiner.Held} {
+		if ts, ok := h(); ok && !ts.docker.IsZero() && (held.IsZero() || ts.docker.Before(held)) {
+			held = ts.docker
+		}
+	}
+	return held, !held.IsZero()
+}
+
+// flush returns the entries held back by the log stream, regardless of
+// whether they're complete.
+func (s *streamState) flush() []streamEntry {
+	var entries []streamEntry
+	if ts, line, ok := s.joiner.Flush(); ok {
+		if ts, line, ok := s.multiline.Add(ts, line); ok {
+			entries = append(entries, streamEntry{ts, line})
+		}
+	}
+	if ts, line, ok := s.multiline.Flush(); ok {
+		entries = append(entries, streamEntry{ts, line})
+	}
+	return entries
+}
 
-	for isPrefix && err == nil {
-		line, isPrefix, err = r.ReadLine()
-		ln = append(ln, line...)
+// streamEntry is an entry of a log stream along with its timestamps.
+type streamEntry struct {
+	ts   lineStamp
+	line string
+}
+
+func (t *Target) newStreamState(stream logStream) *streamState {
+	return &streamState{
+		logStream: stream,
+		joiner:    newContinuationJoiner(t.opts.ContinuationMarker, stream.config.multilineMaxLines),
+		multiline: newMultilineAggregator(stream.config.firstLine, t.multilineSeparator(), stream.config.multilineMaxLines),
 	}
+}
+
+// entryBatch holds entries to send along with the log streams they were
+// read from and their Docker timestamps.
+type entryBatch struct {
+	entries  []loki.Entry
+	streams  []string
+	dockerTs []time.Time
+	// held is the Docker timestamp of the oldest entry held back by any of
+	// the log streams, if any. The position doesn't advance past it, so that
+	// the entry is read again if the log stream is re-established before
+	// it's complete.
+	held time.Time
+	// shed is the Docker timestamp of the most recent entry dropped as its
+	// lag exceeded Options.MaxLag, if any. The position advances past it once
+	// the batch is sent, so that shed entries aren't read again.
+	shed time.Time
+}
+
+func (b *entryBatch) Len() int { return len(b.entries) }
 
-	return string(ln), err
+func (b *entryBatch) reset() {
+	b.entries = b.entries[:0]
+	b.streams = b.streams[:0]
+	b.dockerTs = b.dockerTs[:0]
+	b.shed = time.Time{}
 }
 
-func (t *Target) process(r io.Reader, logStreamLset model.LabelSet) {
+// process processes the lines of all log streams in the order they're
+// received in, until lines is closed.
+func (t *Target) process(ctx context.Context, lines <-chan streamLine, streams []*streamState) {
 	defer func() {
 		t.wg.Done()
 	}()
 
-	reader := bufio.NewReader(r)
+	byName := make(map[string]*streamState, len(streams))
+	for _, stream := range streams {
+		byName[stream.name] = stream
+	}
+
+	batch := &entryBatch{
+		entries:  make([]loki.Entry, 0, t.batchSize()),
+		streams:  make([]string, 0, t.batchSize()),
+		dockerTs: make([]time.Time, 0, t.batchSize()),
+	}
+	emit := func(stream *streamState, ts lineStamp, line string) {
+		if stream.replay.Seen(stream.name, ts.docker, line) {
+			t.metrics.dockerDedupSuppressed.Inc()
+			t.counters.deduplicated.Inc()
+			return
+		}
+		if !ts.docker.IsZero() {
+			lag := time.Since(ts.docker)
+			t.metrics.dockerIngestionLag.Observe(lag.Seconds())
+			if t.opts.MaxLag > 0 && lag > t.opts.MaxLag {
+				t.metrics.dockerLagDropped.Inc()
+				t.counters.dropped.Inc()
+				if ts.docker.After(batch.shed) {
+					batch.shed = ts.docker
+				}
+				return
+			}
+		}
+		line, hasNullBytes := t.nullBytes.Apply(line)
+		if hasNullBytes {
+			t.metrics.dockerNullBytes.Inc()
+			if t.nullBytes.policy == NullBytePolicyDrop {
+				t.counters.dropped.Inc()
+				return
+			}
+		}
+		if t.levels.Drop(line) {
+			t.metrics.dockerLevelFiltered.Inc()
+			t.counters.dropped.Inc()
+			return
+		}
+		truncated := t.isTruncated(line)
+		if t.opts.KeepTimestampPrefix {
+			line = ts.prefix + line
+		}
+		entry := newEntry(stream.logStream, ts.ts, line)
+		if truncated {
+			entry.Labels = stream.truncatedLabels
+		}
+		if l := t.opts.LabelRateLimiter; l != nil {
+			if !l.allow(entry.Labels, time.Now()) {
+				t.metrics.dockerLabelRateLimited.Inc()
+				t.counters.dropped.Inc()
+				return
+			}
+		}
+		if truncated {
+			t.metrics.dockerTruncated.Inc()
+			t.counters.truncated.Inc()
+		}
+		batch.entries = append(batch.entries, entry)
+		batch.streams = append(batch.streams, stream.name)
+		batch.dockerTs = append(batch.dockerTs, ts.docker)
+	}
+
 	for {
-		line, err := readLine(reader)
-		if err != nil {
-			if err == io.EOF {
-				break
+		// Incomplete entries are flushed once no more lines of their
+		// log stream arrived in time. Lines can be read in the meantime, so
+		// that they're flushed even while the other log stream keeps logging.
+		var (
+			timer   *time.Timer
+			timeout <-chan time.Time
+		)
+		if deadline, ok := nextDeadline(streams); ok {
+			timer = time.NewTimer(time.Until(deadline))
+			timeout = timer.C
+		}
+
+		select {
+		case now := <-timeout:
+			for _, stream := range streams {
+				if !stream.pending() || now.Before(stream.deadline) {
+					continue
+				}
+				for _, e := range stream.flush() {
+					emit(stream, e.ts, e.line)
+				}
+			}
+		case sl, ok := <-lines:
+			if !ok {
+				// The stream ended; entries still waiting for their continuation
+				// won't get one anymore.
+				for _, stream := range streams {
+					for _, e := range stream.flush() {
+						emit(stream, e.ts, e.line)
+					}
+				}
+				if batch.Len() == 0 || t.send(ctx, batch) {
+					t.skip(batch)
+				}
+				return
 			}
-			level.Error(t.logger).Log("msg", "error reading docker log line, skipping line", "err", err)
-			t.metrics.dockerErrors.Inc()
+			stream := byName[sl.stream]
+
+			dockerTs, line, dockerErr := extractTs(sl.line)
+			prefix := sl.line[:len(sl.line)-len(line)]
+			if t.opts.StripBOM {
+				line = strings.TrimPrefix(line, utf8BOM)
+			}
+			resolved, err := t.timestamps.Resolve(dockerTs, dockerErr, line)
+			if err != nil {
+				level.Error(t.logger).Log("msg", "could not extract timestamp, skipping line", "err", err)
+				t.metrics.dockerErrors.Inc()
+				t.counters.errors.Inc()
+				continue
+			}
+			ts := lineStamp{ts: resolved, prefix: prefix}
+			if dockerErr == nil {
+				ts.docker = dockerTs
+			}
+
+			ts, line, ok = stream.joiner.Add(ts, line)
+			if ok {
+				ts, line, ok = stream.multiline.Add(ts, line)
+			}
+			if stream.pending() {
+				stream.deadline = time.Now().Add(stream.config.multilineMaxWait)
+			}
+			if ok {
+				emit(stream, ts, line)
+			}
+
+			// Send the batch once it's full or once no more input is readily
+			// available, so that entries aren't held back waiting for more lines.
+			if batch.Len() < t.batchSize() && len(lines) > 0 {
+				continue
+			}
+		}
+		if timer != nil {
+			timer.Stop()
 		}
 
-		ts, line, err := extractTs(line)
-		if err != nil {
-			level.Error(t.logger).Log("msg", "could not extract timestamp, skipping line", "err", err)
-			t.metrics.dockerErrors.Inc()
+		if batch.Len() == 0 && batch.shed.IsZero() {
 			continue
 		}
+		batch.held = heldSince(streams)
+		if batch.Len() > 0 && !t.send(ctx, batch) {
+			// The entries weren't sent, so the position isn't updated and the
+			// lines will be read again once the stream is re-established. Drain
+			// the remaining input so that the writing side isn't blocked.
+			for range lines {
+			}
+			return
+		}
+		t.skip(batch)
+		batch.reset()
+	}
+}
+
+// nextDeadline returns the earliest deadline of the log streams which hold
+// back an incomplete entry.
+func nextDeadline(streams []*streamState) (time.Time, bool) {
+	var (
+		next  time.Time
+		found bool
+	)
+	for _, stream := range streams {
+		if stream.pending() && (!found || stream.deadline.Before(next)) {
+			next, found = stream.deadline, true
+		}
+	}
+	return next, found
+}
 
-		t.handler.Chan() <- loki.Entry{
-			Labels: logStreamLset,
-			Entry: logproto.Entry{
-				Timestamp: ts,
-				Line:      line,
-			},
+// heldSince returns the Docker timestamp of the oldest entry held back by any
+// of the log streams, or zero if none is held back.
+func heldSince(streams []*streamState) time.Time {
+	var held time.Time
+	for _, stream := range streams {
+		if ts, ok := stream.held(); ok && (held.IsZero() || ts.Before(held)) {
+			held = ts
 		}
-		t.metrics.dockerEntries.Inc()
+	}
+	return held
+}
+
+func newEntry(stream logStream, ts time.Time, line string) loki.Entry {
+	return loki.Entry{
+		Labels: stream.labels,
+		Entry: logproto.Entry{
+			Timestamp: ts,
+			Line:      line,
+			// The capacity is limited so that appending to the metadata of one
+			// entry doesn't modify the one of others.
+			StructuredMetadata: stream.metadata[:len(stream.metadata):len(stream.metadata)],
+		},
+	}
+}
+
+func (t *Target) multilineSeparator() string {
+	if t.opts.MultilineSeparator == "" {
+		return defaultMultilineSeparator
+	}
+	return t.opts.MultilineSeparator
+}
+
+func (t *Target) multilineMaxWait() time.Duration {
+	if t.opts.MultilineMaxWait <= 0 {
+		return defaultMultilineMaxWait
+	}
+	return t.opts.MultilineMaxWait
+}
+
+func (t *Target) multilineMaxLines() int {
+	if t.opts.MultilineMaxLines <= 0 {
+		return defaultMultilineMaxLines
+	}
+	return t.opts.MultilineMaxLines
+}
+
+// batchSize returns the maximum number of entries sent to the handler at
+// once.
+func (t *Target) batchSize() int {
+	switch {
+	case t.opts.BatchHandler == nil:
+		return 1
+	case t.opts.MaxBatchSize <= 0:
+		return defaultMaxBatchSize
+	default:
+		return t.opts.MaxBatchSize
+	}
+}
+
+// send hands over entries to the handler and records the position of the
+// sent entries. It returns false if ctx was canceled before all entries could
+// be sent.
+func (t *Target) send(ctx context.Context, batch *entryBatch) bool {
+	if t.opts.BatchHandler != nil {
+		// Flushing held back entries may add several entries at once, so the
+		// batch can be larger than the maximum size.
+		size := t.batchSize()
+		for start := 0; start < batch.Len(); start += size {
+			if ctx.Err() != nil {
+				return false
+			}
+			end := min(start+size, batch.Len())
+			t.opts.BatchHandler(batch.entries[start:end])
+			for i := start; i < end; i++ {
+				t.sent(batch.streams[i], batch.entries[i], batch.dockerTs[i], batch.held)
+			}
+		}
+		return true
+	}
+
+	for i, entry := range batch.entries {
+		select {
+		case <-ctx.Done():
+			return false
+		case t.handlerFor(batch.streams[i]).Chan() <- entry:
+		}
+		t.sent(batch.streams[i], entry, batch.dockerTs[i], batch.held)
+	}
+	return true
+}
+
+// handlerFor returns the handler of the entries of a log stream.
+func (t *Target) handlerFor(logStream string) loki.EntryHandler {
+	switch {
+	case logStream == "stdout" && t.opts.StdoutHandler != nil:
+		return t.opts.StdoutHandler
+	case logStream == "stderr" && t.opts.StderrHandler != nil:
+		return t.opts.StderrHandler
+	default:
+		return t.handler
+	}
+}
+
+// sent records an entry which was handed over to the handler. dockerTs is
+// the timestamp Docker recorded the entry at, or zero if it has none, in
+// which case the position is left as is. The position doesn't advance past
+// held, the Docker timestamp of the oldest entry held back, unless it's zero.
+func (t *Target) sent(logStream string, entry loki.Entry, dockerTs, held time.Time) {
+	t.setStatus(StatusReading)
+	t.metrics.dockerEntries.Inc()
+	t.counters.read.Inc()
+	t.recent.Add(entry)
+	if err := t.debug.Write(entry); err != nil {
+		level.Warn(t.logger).Log("msg", "could not write entry to the debug writer", "err", err)
+	}
+	if !dockerTs.IsZero() {
+		t.dedup.Add(logStream, dockerTs, entry.Line)
 
 		// NOTE(@tpaschalis) We don't save the positions entry with the
 		// filtered labels, but with the default label set, as this is the one
@@ -218,17 +959,51 @@ func (t *Target) process(r io.Reader, logStreamLset model.LabelSet) {
 		// problematic if we have the same container with a different set of
 		// labels (e.g. duplicated and relabeled), but this shouldn't be the
 		// case anyway.
-		t.positions.Put(positions.CursorKey(t.containerName), t.labelsStr, ts.Unix())
-		t.since = ts.Unix()
+		t.advance(dockerTs, held)
 	}
+	t.maybeSyncPositions()
+}
+
+// skip advances the position past the entries of a sent batch which were
+// shed for lagging, unless it's already past them.
+func (t *Target) skip(batch *entryBatch) {
+	if batch.shed.IsZero() || batch.shed.Unix() <= t.since.Load() {
+		return
+	}
+	t.advance(batch.shed, batch.held)
+	t.maybeSyncPositions()
+}
+
+// advance moves the position to dockerTs, but not past held, the Docker
+// timestamp of the oldest entry held back, unless it's zero.
+func (t *Target) advance(dockerTs, held time.Time) {
+	pos := dockerTs
+	if !held.IsZero() && held.Before(pos) {
+		pos = held
+	}
+	t.putPosition(pos.Unix())
+	t.since.Store(pos.Unix())
 }
 
 // StartIfNotRunning starts processing container logs. The operation is idempotent , i.e. the processing cannot be started twice.
+// If the target is paused, processing starts once it's resumed.
 func (t *Target) StartIfNotRunning() {
+	if t.paused.Load() {
+		t.startOnResume.Store(true)
+		return
+	}
 	if t.running.CompareAndSwap(false, true) {
+		ctx, cancel, ok := t.startContext()
+		if !ok {
+			level.Debug(t.logger).Log("msg", "not starting process loop as the maximum lifetime of the target is over", "container", t.containerName)
+			t.running.Store(false)
+			return
+		}
 		level.Debug(t.logger).Log("msg", "starting process loop", "container", t.containerName)
-		ctx, cancel := context.WithCancel(context.Background())
+		t.mut.Lock()
 		t.cancel = cancel
+		t.mut.Unlock()
+		t.wg.Add(1)
 		go t.processLoop(ctx)
 	} else {
 		level.Debug(t.logger).Log("msg", "attempted to start process loop but it's already running", "container", t.containerName)
@@ -237,11 +1012,77 @@ func (t *Target) StartIfNotRunning() {
 
 // Stop shuts down the target.
 func (t *Target) Stop() {
-	t.cancel()
+	t.startOnResume.Store(false)
+	t.stop(nil)
+}
+
+// stop stops the process loop and waits for it to exit. A non-nil cause
+// stops the target with that error, as if it stopped by itself.
+func (t *Target) stop(cause error) {
+	t.mut.Lock()
+	cancel := t.cancel
+	t.mut.Unlock()
+	if cancel != nil {
+		cancel(cause)
+	}
 	t.wg.Wait()
 	level.Debug(t.logger).Log("msg", "stopped Docker target", "container", t.containerName)
 }
 
+// Pause stops reading logs until Resume is called. The position is kept, so
+// that reading continues where it stopped.
+func (t *Target) Pause() {
+	if !t.paused.CompareAndSwap(false, true) {
+		return
+	}
+	level.Info(t.logger).Log("msg", "pausing Docker target", "container", t.containerName)
+	t.startOnResume.Store(t.running.Load())
+	t.stop(nil)
+	t.setStatus(StatusPaused)
+}
+
+// Resume continues reading logs after Pause, if the target was running or
+// was started in the meantime.
+func (t *Target) Resume() {
+	if !t.paused.CompareAndSwap(true, false) {
+		return
+	}
+	level.Info(t.logger).Log("msg", "resuming Docker target", "container", t.containerName)
+	t.setStatus(StatusStopped)
+	if t.startOnResume.Swap(false) {
+		t.StartIfNotRunning()
+	}
+}
+
+// Reconnect closes the current log stream and re-establishes it from the last
+// read position. Entries which were read but not yet handed over to the
+// handler are read again from the new stream, while entries which were
+// already sent are skipped. It's a no-op if the target isn't running.
+func (t *Target) Reconnect() {
+	t.reconnect(reconnectReasonManual)
+}
+
+func (t *Target) reconnect(reason string) {
+	if !t.running.Load() {
+		level.Debug(t.logger).Log("msg", "not reconnecting to Docker log stream as the target isn't running", "container", t.containerName)
+		return
+	}
+	if err := t.countReconnect(reason); err != nil {
+		t.startOnResume.Store(false)
+		t.stop(err)
+		return
+	}
+	t.Stop()
+	t.StartIfNotRunning()
+}
+
+// RecentEntries returns up to n of the most recent entries sent by the
+// target, from oldest to newest. At most Options.RecentEntriesSize entries
+// are kept.
+func (t *Target) RecentEntries(n int) []loki.Entry {
+	return t.recent.Last(n)
+}
+
 // Ready reports whether the target is running.
 func (t *Target) Ready() bool {
 	return t.running.Load()
@@ -273,21 +1114,43 @@ func (t *Target) Details() map[string]string {
 	if t.err != nil {
 		errMsg = t.err.Error()
 	}
+	t.mut.Lock()
+	reconnectReason := t.reconnectReason
+	t.mut.Unlock()
 	return map[string]string{
-		"id":       t.containerName,
-		"error":    errMsg,
-		"position": t.positions.GetString(positions.CursorKey(t.containerName), t.labelsStr),
-		"running":  strconv.FormatBool(t.running.Load()),
+		"id":               t.containerName,
+		"error":            errMsg,
+		"position":         t.positions.GetString(positions.CursorKey(t.containerName), t.labelsStr),
+		"running":          strconv.FormatBool(t.running.Load()),
+		"status":           string(t.Status()),
+		"reconnect_reason": reconnectReason,
 	}
 }
 
-func (t *Target) getStreamLabels(logStream string) model.LabelSet {
-	// Add all labels from the config, relabel and filter them.
+func (t *Target) getStreamLabels(logStream string, meta model.LabelSet) model.LabelSet {
+	// Add all labels from the config and the container's meta labels, render
+	// the templated labels, relabel and filter them.
 	lb := labels.NewBuilder(nil)
 	for k, v := range t.labels {
 		lb.Set(string(k), string(v))
 	}
+	for k, v := range meta {
+		lb.Set(string(k), string(v))
+	}
 	lb.Set(dockerLabelLogStream, logStream)
+	if len(t.templates) > 0 {
+		lset := lb.Labels()
+		for _, lt := range t.templates {
+			value, err := lt.render(lset)
+			if err != nil {
+				level.Warn(t.logger).Log("msg", "could not render label template", "container", t.containerName, "label", lt.name, "err", err)
+				continue
+			}
+			if value != "" {
+				lb.Set(string(lt.name), value)
+			}
+		}
+	}
 	processed, _ := relabel.Process(lb.Labels(), t.relabelConfig...)
 
 	filtered := make(model.LabelSet)
@@ -5,26 +5,39 @@ package dockertarget
 // read logs from Docker containers and forward them to other loki components.
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/grafana/agent/component/common/loki"
 	"github.com/grafana/agent/component/common/loki/client/fake"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/go-kit/log"
 	"github.com/grafana/agent/component/common/loki/positions"
+	flow_relabel "github.com/grafana/agent/component/common/relabel"
+	"github.com/grafana/agent/component/loki/source/docker/internal/fakedocker"
+	"github.com/grafana/loki/pkg/push"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/model/relabel"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+	"golang.org/x/time/rate"
+	yaml "gopkg.in/yaml.v2"
 )
 
 func TestDockerTarget(t *testing.T) {
@@ -78,6 +91,7 @@ func TestDockerTarget(t *testing.T) {
 		model.LabelSet{"job": "docker"},
 		[]*relabel.Config{},
 		client,
+		Options{},
 	)
 	require.NoError(t, err)
 	tgt.StartIfNotRunning()
@@ -128,3 +142,2288 @@ func TestDockerTarget(t *testing.T) {
 	}
 	require.ElementsMatch(t, actualLinesAfterRestart, expectedLinesAfterRestart)
 }
+
+func TestDockerTargetStreamOrder(t *testing.T) {
+	// The lines of both streams are interleaved, and some of them span
+	// several frames.
+	start := time.Date(2023, time.December, 9, 9, 16, 0, 0, time.UTC)
+	var expected []string
+	h := func(w http.ResponseWriter, r *http.Request) {
+		switch path := r.URL.Path; {
+		case strings.HasSuffix(path, "/logs"):
+			stdout := stdcopy.NewStdWriter(w, stdcopy.Stdout)
+			stderr := stdcopy.NewStdWriter(w, stdcopy.Stderr)
+			for i, line := range expected {
+				sw := stdout
+				if i%3 == 0 {
+					sw = stderr
+				}
+				ts := start.Add(time.Duration(i) * time.Millisecond).Format(time.RFC3339Nano)
+				half := len(line) / 2
+				for _, frame := range []string{ts + " " + line[:half], line[half:] + "\n"} {
+					_, err := sw.Write([]byte(frame))
+					require.NoError(t, err)
+				}
+			}
+		default:
+			writeContainerJSON(t, w, types.ContainerJSON{
+				ContainerJSONBase: &types.ContainerJSONBase{},
+				Config:            &container.Config{},
+			})
+		}
+	}
+	for i := 0; i < 100; i++ {
+		stream := "stdout"
+		if i%3 == 0 {
+			stream = "stderr"
+		}
+		expected = append(expected, fmt.Sprintf("%s line %d", stream, i))
+	}
+
+	tgt, entryHandler, _ := newTestTarget(t, h, Options{})
+	tgt.StartIfNotRunning()
+	defer tgt.Stop()
+
+	require.Eventually(t, func() bool {
+		return len(entryHandler.Received()) == len(expected)
+	}, 5*time.Second, 10*time.Millisecond)
+	var actual []string
+	for _, entry := range entryHandler.Received() {
+		actual = append(actual, entry.Line)
+	}
+	require.Equal(t, expected, actual)
+}
+
+func TestDockerTargetReconnect(t *testing.T) {
+	// Each line is one second apart, so that the since parameter of the
+	// re-established stream can be honored by the fake daemon.
+	start := time.Date(2023, time.December, 9, 9, 16, 0, 0, time.UTC)
+	lines := make([]string, 6)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("%s line %d", start.Add(time.Duration(i)*time.Second).Format(time.RFC3339Nano), i)
+	}
+
+	var requests atomic.Int64
+	h := func(w http.ResponseWriter, r *http.Request) {
+		switch path := r.URL.Path; {
+		case strings.HasSuffix(path, "/logs"):
+			since, err := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+			require.NoError(t, err)
+
+			if requests.Inc() == 1 {
+				// Send the first half of the lines and keep the stream open as a
+				// running container would.
+				fakedocker.WriteMuxedLines(t, w, stdcopy.Stdout, lines[:3]...)
+				w.(http.Flusher).Flush()
+				<-r.Context().Done()
+				return
+			}
+
+			var remaining []string
+			for i, line := range lines {
+				if start.Add(time.Duration(i)*time.Second).Unix() >= since {
+					remaining = append(remaining, line)
+				}
+			}
+			fakedocker.WriteMuxedLines(t, w, stdcopy.Stdout, remaining...)
+		default:
+			writeContainerJSON(t, w, types.ContainerJSON{
+				ContainerJSONBase: &types.ContainerJSONBase{},
+				Config:            &container.Config{Tty: false},
+			})
+		}
+	}
+
+	tgt, entryHandler, _ := newTestTarget(t, h, Options{})
+	tgt.StartIfNotRunning()
+	defer tgt.Stop()
+
+	require.Eventually(t, func() bool {
+		return len(entryHandler.Received()) == 3
+	}, 5*time.Second, 10*time.Millisecond)
+
+	tgt.Reconnect()
+	require.Equal(t, reconnectReasonManual, tgt.Details()["reconnect_reason"])
+
+	require.Eventually(t, func() bool {
+		return requests.Load() == 2 && !tgt.Ready()
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The last line of the first stream is read again since Docker only
+	// supports a resolution of seconds, but it's only sent once.
+	var received []string
+	for _, entry := range entryHandler.Received() {
+		received = append(received, entry.Line)
+	}
+	sort.Strings(received)
+	for i := range lines {
+		require.Equal(t, fmt.Sprintf("line %d", i), received[i])
+	}
+	require.Len(t, received, len(lines))
+}
+
+func TestDockerTargetReconnectStopped(t *testing.T) {
+	d := fakedocker.New(t)
+	d.AddContainer("flog", "/flog", "2023-12-09T09:16:57.000000000Z started")
+
+	tgt, entryHandler, _ := newTestTargetWithClient(t, d.Client(), "flog", Options{})
+	tgt.StartIfNotRunning()
+	require.Eventually(t, func() bool {
+		return len(entryHandler.Received()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	tgt.Stop()
+
+	// Reconnecting doesn't start a stopped target.
+	tgt.Reconnect()
+	require.False(t, tgt.Ready())
+	require.Empty(t, tgt.Details()["reconnect_reason"])
+	require.Never(t, func() bool {
+		return d.OpenStreams("flog") > 0
+	}, 200*time.Millisecond, 10*time.Millisecond)
+	require.Len(t, d.Attaches("flog"), 1)
+}
+
+func TestDockerTargetDedupSuppressed(t *testing.T) {
+	d := fakedocker.New(t)
+	d.AddContainer("flog", "/flog",
+		"2023-12-09T09:16:56.000000000Z before",
+		"2023-12-09T09:16:57.000000000Z first",
+		"2023-12-09T09:16:57.100000000Z repeated",
+		"2023-12-09T09:16:57.100000000Z repeated",
+	)
+
+	tgt, entryHandler, _ := newTestTargetWithClient(t, d.Client(), "flog", Options{})
+	tgt.StartIfNotRunning()
+	defer tgt.Stop()
+	require.Eventually(t, func() bool {
+		return len(entryHandler.Received()) == 4
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The stream is re-established from second 57, so its three lines are read
+	// again. A new line within the same second is still sent.
+	d.AppendLines("flog", "2023-12-09T09:16:57.100000000Z repeated")
+	tgt.Reconnect()
+	require.Eventually(t, func() bool {
+		return len(entryHandler.Received()) == 5
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, "repeated", entryHandler.Received()[4].Line)
+	require.Equal(t, 3.0, testutil.ToFloat64(tgt.metrics.dockerDedupSuppressed))
+}
+
+func TestDockerTargetReconnectLimiter(t *testing.T) {
+	const every = 50 * time.Millisecond
+	d := fakedocker.New(t)
+	limiter := NewReconnectLimiter(rate.Every(every), 1)
+
+	var targets []*Target
+	for i := 0; i < 5; i++ {
+		id := fmt.Sprintf("c%d", i)
+		d.AddContainer(id, "/"+id, "2023-12-09T09:16:57Z "+id)
+		tgt, _, _ := newTestTargetWithClient(t, d.Client(), id, Options{ReconnectLimiter: limiter})
+		tgt.StartIfNotRunning()
+		defer tgt.Stop()
+		targets = append(targets, tgt)
+	}
+	attached := func(n int) bool {
+		for _, tgt := range targets {
+			if len(d.Attaches(tgt.Name())) != n {
+				return false
+			}
+		}
+		return true
+	}
+	// Connecting for the first time isn't limited.
+	require.Eventually(t, func() bool { return attached(1) }, 5*time.Second, 10*time.Millisecond)
+
+	var wg sync.WaitGroup
+	for _, tgt := range targets {
+		wg.Add(1)
+		go func(tgt *Target) {
+			defer wg.Done()
+			tgt.Reconnect()
+		}(tgt)
+	}
+	wg.Wait()
+	require.Eventually(t, func() bool { return attached(2) }, 5*time.Second, 10*time.Millisecond)
+
+	// All but the first reconnect are spread out by the limiter.
+	var (
+		first, last time.Time
+		throttled   float64
+	)
+	for _, tgt := range targets {
+		ts := d.Attaches(tgt.Name())[1]
+		if first.IsZero() || ts.Before(first) {
+			first = ts
+		}
+		if ts.After(last) {
+			last = ts
+		}
+		throttled += testutil.ToFloat64(tgt.metrics.dockerReconnectsThrottled)
+	}
+	require.Equal(t, 4.0, throttled)
+	require.GreaterOrEqual(t, last.Sub(first), 3*every)
+}
+
+func TestDockerTargetReconnectLimiterReplaced(t *testing.T) {
+	d := fakedocker.New(t)
+	d.AddContainer("flog", "/flog", "2023-12-09T09:16:57Z flog")
+	limiter := NewReconnectLimiter(rate.Every(time.Hour), 1)
+
+	first, _, _ := newTestTargetWithClient(t, d.Client(), "flog", Options{ReconnectLimiter: limiter})
+	first.StartIfNotRunning()
+	require.Eventually(t, func() bool { return len(d.Attaches("flog")) == 1 }, 5*time.Second, 10*time.Millisecond)
+	first.Stop()
+
+	// The target replacing the first one takes the burst...
+	second, _, _ := newTestTargetWithClient(t, d.Client(), "flog", Options{ReconnectLimiter: limiter})
+	second.StartIfNotRunning()
+	require.Eventually(t, func() bool { return len(d.Attaches("flog")) == 2 }, 5*time.Second, 10*time.Millisecond)
+	second.Stop()
+
+	// ...and the one after is delayed.
+	third, _, _ := newTestTargetWithClient(t, d.Client(), "flog", Options{ReconnectLimiter: limiter})
+	third.StartIfNotRunning()
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(third.metrics.dockerReconnectsThrottled) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	third.Stop()
+	require.Len(t, d.Attaches("flog"), 2)
+
+	// Forgotten containers aren't limited anymore.
+	limiter.Retain(nil)
+	fourth, _, _ := newTestTargetWithClient(t, d.Client(), "flog", Options{ReconnectLimiter: limiter})
+	fourth.StartIfNotRunning()
+	defer fourth.Stop()
+	require.Eventually(t, func() bool { return len(d.Attaches("flog")) == 3 }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestDockerTargetContinuationJoin(t *testing.T) {
+	h := func(w http.ResponseWriter, r *http.Request) {
+		switch path := r.URL.Path; {
+		case strings.HasSuffix(path, "/logs"):
+			fakedocker.WriteMuxedLines(t, w, stdcopy.Stdout,
+				"2023-12-09T09:16:57.000000000Z first \\",
+				"2023-12-09T09:16:57.100000000Z second \\",
+				"2023-12-09T09:16:57.200000000Z third",
+				"2023-12-09T09:16:58.000000000Z standalone",
+				"2023-12-09T09:16:59.000000000Z dangling \\",
+			)
+		default:
+			writeContainerJSON(t, w, types.ContainerJSON{
+				ContainerJSONBase: &types.ContainerJSONBase{},
+				Config:            &container.Config{Tty: false},
+			})
+		}
+	}
+
+	tgt, entryHandler, _ := newTestTarget(t, h, Options{ContinuationMarker: "\\"})
+	tgt.StartIfNotRunning()
+	defer tgt.Stop()
+
+	require.Eventually(t, func() bool {
+		return len(entryHandler.Received()) == 3
+	}, 5*time.Second, 10*time.Millisecond)
+
+	received := entryHandler.Received()
+	require.Equal(t, "first second third", received[0].Line)
+	require.Equal(t, time.Date(2023, time.December, 9, 9, 16, 57, 0, time.UTC), received[0].Timestamp.UTC())
+	require.Equal(t, "standalone", received[1].Line)
+	// A continued line at the end of the stream is emitted without the marker.
+	require.Equal(t, "dangling ", received[2].Line)
+}
+
+func TestDockerTargetMultiline(t *testing.T) {
+	tests := map[string]struct {
+		separator string
+		expect    string
+	}{
+		"default separator":    {separator: "", expect: "panic: oops\n\tat main()\n\tat runtime.main()"},
+		"configured separator": {separator: " | ", expect: "panic: oops | \tat main() | \tat runtime.main()"},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			d := fakedocker.New(t)
+			d.AddContainer("flog", "/flog",
+				"2023-12-09T09:16:57.000000000Z panic: oops",
+				"2023-12-09T09:16:57.100000000Z \tat main()",
+				"2023-12-09T09:16:57.200000000Z \tat runtime.main()",
+				"2023-12-09T09:16:58.000000000Z recovered",
+			)
+
+			tgt, entryHandler, _ := newTestTargetWithClient(t, d.Client(), "flog", Options{
+				MultilineFirstLine: `^\S`,
+				MultilineSeparator: tc.separator,
+				MultilineMaxWait:   50 * time.Millisecond,
+			})
+			tgt.StartIfNotRunning()
+			defer tgt.Stop()
+
+			// The last entry is flushed once no more lines arrive in time, as the
+			// log stream is kept open.
+			require.Eventually(t, func() bool {
+				return len(entryHandler.Received()) == 2
+			}, 5*time.Second, 10*time.Millisecond)
+
+			received := entryHandler.Received()
+			require.Equal(t, tc.expect, received[0].Line)
+			require.Equal(t, time.Date(2023, time.December, 9, 9, 16, 57, 0, time.UTC), received[0].Timestamp.UTC())
+			require.Equal(t, "recovered", received[1].Line)
+		})
+	}
+}
+
+func TestDockerTargetContinuationJoinLimits(t *testing.T) {
+	h := func(w http.ResponseWriter, r *http.Request) {
+		switch path := r.URL.Path; {
+		case strings.HasSuffix(path, "/logs"):
+			fakedocker.WriteMuxedLines(t, w, stdcopy.Stdout,
+				"2023-12-09T09:16:57.000000000Z first \\",
+				"2023-12-09T09:16:57.100000000Z second \\",
+				"2023-12-09T09:16:57.200000000Z third \\",
+				"2023-12-09T09:16:58.000000000Z dangling \\",
+			)
+			w.(http.Flusher).Flush()
+			// The container keeps running without logging the continuation.
+			<-r.Context().Done()
+		default:
+			writeContainerJSON(t, w, types.ContainerJSON{
+				ContainerJSONBase: &types.ContainerJSONBase{},
+				Config:            &container.Config{Tty: false},
+			})
+		}
+	}
+
+	tgt, entryHandler, _ := newTestTarget(t, h, Options{
+		ContinuationMarker: "\\",
+		MultilineMaxWait:   50 * time.Millisecond,
+		MultilineMaxLines:  3,
+	})
+	tgt.StartIfNotRunning()
+	defer tgt.Stop()
+
+	require.Eventually(t, func() bool {
+		return len(entryHandler.Received()) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	received := entryHandler.Received()
+	// The joined entry is complete after the maximum number of lines.
+	require.Equal(t, "first second third ", received[0].Line)
+	// The last entry is flushed after the maximum wait.
+	require.Equal(t, "dangling ", received[1].Line)
+}
+
+func TestDockerTargetMultilineBusyStream(t *testing.T) {
+	// stderr keeps logging single line entries while the multiline entry of
+	// stdout is incomplete.
+	start := time.Now().UTC()
+	h := func(w http.ResponseWriter, r *http.Request) {
+		switch path := r.URL.Path; {
+		case strings.HasSuffix(path, "/logs"):
+			fakedocker.WriteMuxedLines(t, w, stdcopy.Stdout, start.Format(time.RFC3339Nano)+" panic: oops")
+			w.(http.Flusher).Flush()
+			for i := 0; i < 300; i++ {
+				select {
+				case <-r.Context().Done():
+					return
+				case <-time.After(10 * time.Millisecond):
+				}
+				fakedocker.WriteMuxedLines(t, w, stdcopy.Stderr, time.Now().UTC().Format(time.RFC3339Nano)+" request "+strconv.Itoa(i))
+				w.(http.Flusher).Flush()
+			}
+			<-r.Context().Done()
+		default:
+			writeContainerJSON(t, w, types.ContainerJSON{
+				ContainerJSONBase: &types.ContainerJSONBase{},
+				Config:            &container.Config{},
+			})
+		}
+	}
+
+	tgt, entryHandler, _ := newTestTarget(t, h, Options{
+		MultilineFirstLine: `^\S`,
+		MultilineMaxWait:   100 * time.Millisecond,
+	})
+	tgt.StartIfNotRunning()
+	defer tgt.Stop()
+
+	// The stdout entry is flushed once stdout didn't log in time, although
+	// lines of stderr keep arriving.
+	require.Eventually(t, func() bool {
+		for _, entry := range entryHandler.Received() {
+			if entry.Line == "panic: oops" {
+				return true
+			}
+		}
+		return false
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestDockerTargetMultilineHeldPosition(t *testing.T) {
+	start := time.Date(2023, time.December, 9, 9, 16, 0, 0, time.UTC)
+	stamp := func(i int) string { return start.Add(time.Duration(i) * time.Second).Format(time.RFC3339Nano) }
+
+	var requests atomic.Int64
+	h := func(w http.ResponseWriter, r *http.Request) {
+		switch path := r.URL.Path; {
+		case strings.HasSuffix(path, "/logs"):
+			since, err := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+			require.NoError(t, err)
+			if requests.Inc() == 1 {
+				require.Zero(t, since)
+				fakedocker.WriteMuxedLines(t, w, stdcopy.Stdout, stamp(0)+" panic: oops")
+				fakedocker.WriteMuxedLines(t, w, stdcopy.Stderr, stamp(1)+" request 1", stamp(2)+" request 2", stamp(3)+" request 3")
+				w.(http.Flusher).Flush()
+				<-r.Context().Done()
+				return
+			}
+
+			// The incomplete stdout entry is read again, and completed.
+			require.Equal(t, start.Unix(), since)
+			fakedocker.WriteMuxedLines(t, w, stdcopy.Stdout, stamp(0)+" panic: oops", stamp(0)+" \tat main()")
+			fakedocker.WriteMuxedLines(t, w, stdcopy.Stderr, stamp(1)+" request 1", stamp(2)+" request 2", stamp(3)+" request 3")
+		default:
+			writeContainerJSON(t, w, types.ContainerJSON{
+				ContainerJSONBase: &types.ContainerJSONBase{},
+				Config:            &container.Config{},
+			})
+		}
+	}
+
+	tgt, entryHandler, ps := newTestTarget(t, h, Options{
+		MultilineFirstLine: `^(panic|request)`,
+		MultilineMaxWait:   time.Hour,
+	})
+	tgt.StartIfNotRunning()
+	require.Eventually(t, func() bool {
+		return len(entryHandler.Received()) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	tgt.Stop()
+
+	// The position doesn't advance past the held back stdout entry.
+	pos, err := ps.Get(positions.CursorKey("flog"), `{job="docker"}`)
+	require.NoError(t, err)
+	require.Equal(t, start.Unix(), pos)
+
+	tgt.StartIfNotRunning()
+	defer tgt.Stop()
+	require.Eventually(t, func() bool {
+		for _, entry := range entryHandler.Received() {
+			if entry.Line == "panic: oops\n\tat main()" {
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestDockerTargetConfigLabels(t *testing.T) {
+	d := fakedocker.New(t)
+	d.AddContainer("java", "/java",
+		"2023-12-09T09:16:57.000000000Z ignored stdout",
+	)
+	d.AppendStderrLines("java",
+		"2023-12-09T09:16:57.000000000Z Exception: oops",
+		"2023-12-09T09:16:57.100000000Z \tat Main.main()",
+		"2023-12-09T09:16:57.200000000Z \tat Main.run()",
+		"2023-12-09T09:16:57.300000000Z \tat Main.start()",
+		"2023-12-09T09:16:58.000000000Z done",
+	)
+	d.UpdateInfo("java", func(info *types.ContainerJSON) {
+		info.Config.Labels = map[string]string{
+			configLabelMultilineFirstLine: `^\S`,
+			configLabelMultilineMaxLines:  "3",
+			configLabelMultilineMaxWait:   "50ms",
+			configLabelStreams:            "stderr",
+		}
+	})
+	d.AddContainer("invalid", "/invalid",
+		"2023-12-09T09:16:57.000000000Z panic: oops",
+		"2023-12-09T09:16:57.100000000Z \tat main()",
+	)
+	d.UpdateInfo("invalid", func(info *types.ContainerJSON) {
+		info.Config.Labels = map[string]string{
+			configLabelMultilineFirstLine: `(`,
+			configLabelMultilineMaxLines:  "-1",
+			configLabelMultilineMaxWait:   "soon",
+			configLabelStreams:            "both",
+		}
+	})
+
+	// The labels override the options, and invalid labels fall back to them.
+	opts := Options{MultilineMaxWait: 50 * time.Millisecond}
+	java, javaHandler, _ := newTestTargetWithClient(t, d.Client(), "java", opts)
+	invalid, invalidHandler, _ := newTestTargetWithClient(t, d.Client(), "invalid", opts)
+	for _, tgt := range []*Target{java, invalid} {
+		tgt.StartIfNotRunning()
+		defer tgt.Stop()
+	}
+
+	require.Eventually(t, func() bool {
+		return len(javaHandler.Received()) == 3 && len(invalidHandler.Received()) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	received := javaHandler.Received()
+	require.Equal(t, "Exception: oops\n\tat Main.main()\n\tat Main.run()", received[0].Line)
+	require.Equal(t, "\tat Main.start()", received[1].Line)
+	require.Equal(t, "done", received[2].Line)
+
+	received = invalidHandler.Received()
+	require.Equal(t, "panic: oops", received[0].Line)
+	require.Equal(t, "\tat main()", received[1].Line)
+}
+
+func TestDockerTargetMaxLag(t *testing.T) {
+	// The target fell behind and the container logged a backlog of old lines
+	// before the most recent ones.
+	now := time.Now().UTC()
+	var backlog, recent []string
+	for i := 0; i < 50; i++ {
+		ts := now.Add(-time.Hour + time.Duration(i)*time.Second)
+		backlog = append(backlog, ts.Format(time.RFC3339Nano)+" backlog "+strconv.Itoa(i))
+	}
+	for i := 0; i < 3; i++ {
+		ts := now.Add(time.Duration(i) * time.Millisecond)
+		recent = append(recent, ts.Format(time.RFC3339Nano)+" recent "+strconv.Itoa(i))
+	}
+
+	var (
+		requests atomic.Int64
+		since    atomic.Int64
+	)
+	h := func(w http.ResponseWriter, r *http.Request) {
+		switch path := r.URL.Path; {
+		case strings.HasSuffix(path, "/logs"):
+			s, err := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+			require.NoError(t, err)
+			since.Store(s)
+			if requests.Inc() == 1 {
+				// The backlog is read regardless of since, e.g. as the clock of the
+				// daemon is off.
+				fakedocker.WriteMuxedLines(t, w, stdcopy.Stdout, backlog...)
+				w.(http.Flusher).Flush()
+				<-r.Context().Done()
+				return
+			}
+			fakedocker.WriteMuxedLines(t, w, stdcopy.Stdout, recent...)
+		default:
+			writeContainerJSON(t, w, types.ContainerJSON{
+				ContainerJSONBase: &types.ContainerJSONBase{},
+				Config:            &container.Config{},
+			})
+		}
+	}
+
+	tgt, entryHandler, ps := newTestTarget(t, h, Options{MaxLag: time.Minute})
+	tgt.StartIfNotRunning()
+
+	// The log stream is read from MaxLag ago at the earliest.
+	require.Eventually(t, func() bool { return requests.Load() == 1 }, 5*time.Second, 10*time.Millisecond)
+	require.GreaterOrEqual(t, since.Load(), now.Add(-time.Minute).Unix())
+
+	// The position advances past the shed entries, although none was sent.
+	last := now.Add(-time.Hour + 49*time.Second).Unix()
+	require.Eventually(t, func() bool {
+		pos, err := ps.Get(positions.CursorKey("flog"), `{job="docker"}`)
+		return err == nil && pos == last
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Empty(t, entryHandler.Received())
+	require.Equal(t, 50.0, testutil.ToFloat64(tgt.metrics.dockerLagDropped))
+	tgt.Stop()
+
+	// The position is behind by more than MaxLag, so the log stream is
+	// re-established from MaxLag ago.
+	tgt.StartIfNotRunning()
+	defer tgt.Stop()
+	require.Eventually(t, func() bool {
+		return len(entryHandler.Received()) == 3
+	}, 5*time.Second, 10*time.Millisecond)
+	require.GreaterOrEqual(t, since.Load(), now.Add(-time.Minute).Unix())
+	for i, entry := range entryHandler.Received() {
+		require.Equal(t, "recent "+strconv.Itoa(i), entry.Line)
+	}
+}
+
+func TestDockerTargetShortIDPosition(t *testing.T) {
+	fullID := strings.Repeat("0123456789abcdef", 4)
+	d := fakedocker.New(t)
+	d.AddContainer(fullID, "/flog",
+		"2023-12-09T09:16:57.000000000Z old",
+		"2023-12-09T09:16:58.000000000Z new",
+	)
+
+	// The position was written while the daemon reported short IDs.
+	ps, err := positions.New(log.NewNopLogger(), positions.Config{
+		SyncPeriod:    10 * time.Second,
+		PositionsFile: t.TempDir() + "/positions.yml",
+	})
+	require.NoError(t, err)
+	defer ps.Stop()
+	lset := model.LabelSet{"job": "docker"}
+	ps.Put(positions.CursorKey(fullID[:12]), lset.String(), time.Date(2023, 12, 9, 9, 16, 58, 0, time.UTC).Unix())
+
+	entryHandler := fake.NewClient(func() {})
+	tgt, err := NewTarget(NewMetrics(prometheus.NewRegistry()), log.NewNopLogger(), entryHandler, ps, fullID, lset, nil, d.Client(), Options{})
+	require.NoError(t, err)
+	tgt.StartIfNotRunning()
+	defer tgt.Stop()
+
+	require.Eventually(t, func() bool {
+		return len(entryHandler.Received()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, "new", entryHandler.Received()[0].Line)
+
+	// The position was moved to the full ID.
+	require.Equal(t, "", ps.GetString(positions.CursorKey(fullID[:12]), lset.String()))
+	require.Equal(t, "1702113418", ps.GetString(positions.CursorKey(fullID), lset.String()))
+}
+
+func TestDockerTargetStreamHandlers(t *testing.T) {
+	d := fakedocker.New(t)
+	d.AddContainer("flog", "/flog", "2023-12-09T09:16:57.000000000Z out")
+	d.AppendStderrLines("flog", "2023-12-09T09:16:57.000000000Z err")
+
+	t.Run("separate handlers", func(t *testing.T) {
+		stdout, stderr := fake.NewClient(func() {}), fake.NewClient(func() {})
+		defer stdout.Stop()
+		defer stderr.Stop()
+		tgt, entryHandler, _ := newTestTargetWithClient(t, d.Client(), "flog", Options{StdoutHandler: stdout, StderrHandler: stderr})
+		tgt.StartIfNotRunning()
+		defer tgt.Stop()
+
+		require.Eventually(t, func() bool {
+			return len(stdout.Received()) == 1 && len(stderr.Received()) == 1
+		}, 5*time.Second, 10*time.Millisecond)
+		require.Equal(t, "out", stdout.Received()[0].Line)
+		require.Equal(t, "err", stderr.Received()[0].Line)
+		require.Empty(t, entryHandler.Received())
+	})
+
+	t.Run("single handler", func(t *testing.T) {
+		stderr := fake.NewClient(func() {})
+		defer stderr.Stop()
+		tgt, entryHandler, _ := newTestTargetWithClient(t, d.Client(), "flog", Options{StderrHandler: stderr})
+		tgt.StartIfNotRunning()
+		defer tgt.Stop()
+
+		// Without a handler of its own, stdout falls back to the handler of
+		// the target.
+		require.Eventually(t, func() bool {
+			return len(entryHandler.Received()) == 1 && len(stderr.Received()) == 1
+		}, 5*time.Second, 10*time.Millisecond)
+		require.Equal(t, "out", entryHandler.Received()[0].Line)
+		require.Equal(t, "err", stderr.Received()[0].Line)
+	})
+}
+
+func TestDockerTargetStripBOM(t *testing.T) {
+	d := fakedocker.New(t)
+	d.AddContainer("flog", "/flog",
+		"2023-12-09T09:16:57.000000000Z \ufeffstarted",
+		"2023-12-09T09:16:58.000000000Z running",
+	)
+
+	for _, tc := range []struct {
+		stripBOM bool
+		expect   string
+	}{
+		{stripBOM: true, expect: "started"},
+		{stripBOM: false, expect: "\ufeffstarted"},
+	} {
+		tgt, entryHandler, _ := newTestTargetWithClient(t, d.Client(), "flog", Options{StripBOM: tc.stripBOM})
+		tgt.StartIfNotRunning()
+		require.Eventually(t, func() bool {
+			return len(entryHandler.Received()) == 2
+		}, 5*time.Second, 10*time.Millisecond)
+		tgt.Stop()
+
+		require.Equal(t, tc.expect, entryHandler.Received()[0].Line)
+		require.Equal(t, "running", entryHandler.Received()[1].Line)
+	}
+}
+
+func TestDockerTargetTimestampPrefix(t *testing.T) {
+	d := fakedocker.New(t)
+	d.AddContainer("flog", "/flog",
+		"2023-12-09T09:16:57.000000000Z started",
+		"2023-12-09T09:16:58.000000000Z running",
+	)
+
+	for _, tc := range []struct {
+		keep   bool
+		expect []string
+	}{
+		{keep: false, expect: []string{"started", "running"}},
+		{keep: true, expect: []string{
+			"2023-12-09T09:16:57.000000000Z started",
+			"2023-12-09T09:16:58.000000000Z running",
+		}},
+	} {
+		tgt, entryHandler, _ := newTestTargetWithClient(t, d.Client(), "flog", Options{KeepTimestampPrefix: tc.keep})
+		tgt.StartIfNotRunning()
+		require.Eventually(t, func() bool {
+			return len(entryHandler.Received()) == 2
+		}, 5*time.Second, 10*time.Millisecond)
+		tgt.Stop()
+
+		for i, entry := range entryHandler.Received() {
+			require.Equal(t, tc.expect[i], entry.Line)
+			require.Equal(t, time.Date(2023, time.December, 9, 9, 16, 57+i, 0, time.UTC), entry.Timestamp.UTC())
+		}
+	}
+}
+
+func TestDockerTargetMetricsSnapshot(t *testing.T) {
+	now := time.Now().UTC()
+	d := fakedocker.New(t)
+	d.AddContainer("flog", "/flog",
+		now.Format(time.RFC3339Nano)+" ok",
+		now.Format(time.RFC3339Nano)+" cut off [...]",
+		"no timestamp",
+		now.Add(-time.Hour).Format(time.RFC3339Nano)+" lagging",
+		now.Format(time.RFC3339Nano)+` {"level":"debug"}`,
+	)
+
+	// The tail is read without skipping ahead to MaxLag ago, so that the
+	// lagging line is read and dropped.
+	tgt, entryHandler, _ := newTestTargetWithClient(t, d.Client(), "flog", Options{
+		TruncationMarker: "[...]",
+		MaxLag:           time.Minute,
+		Tail:             10,
+		MinLevel:         "info",
+	})
+	tgt.StartIfNotRunning()
+	defer tgt.Stop()
+	require.Eventually(t, func() bool {
+		return len(entryHandler.Received()) == 2 && tgt.MetricsSnapshot().Dropped == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The lines are read again from the last position; the sent ones are
+	// skipped, the lagging one is before the position and the debug one is
+	// filtered again.
+	tgt.Reconnect()
+	require.Eventually(t, func() bool {
+		return tgt.MetricsSnapshot().Errors == 2 && tgt.MetricsSnapshot().Dropped == 3
+	}, 5*time.Second, 10*time.Millisecond)
+
+	snapshot := tgt.MetricsSnapshot()
+	require.Equal(t, MetricsSnapshot{Read: 2, Dropped: 3, Deduplicated: 2, Errors: 2, Reconnects: 1, Truncated: 1}, snapshot)
+	m := tgt.metrics
+	require.Equal(t, float64(snapshot.Read), testutil.ToFloat64(m.dockerEntries))
+	require.Equal(t, float64(snapshot.Dropped), testutil.ToFloat64(m.dockerLagDropped)+testutil.ToFloat64(m.dockerLevelFiltered))
+	require.Equal(t, float64(snapshot.Deduplicated), testutil.ToFloat64(m.dockerDedupSuppressed))
+	require.Equal(t, float64(snapshot.Errors), testutil.ToFloat64(m.dockerErrors))
+	require.Equal(t, float64(snapshot.Reconnects), testutil.ToFloat64(m.dockerReconnects))
+	require.Equal(t, float64(snapshot.Truncated), testutil.ToFloat64(m.dockerTruncated))
+}
+
+func TestDockerTargetMaxLifetime(t *testing.T) {
+	d := fakedocker.New(t)
+	d.AddContainer("flog", "/flog", "2023-12-09T09:16:57.000000000Z running")
+
+	// The positions file isn't written periodically during the test.
+	positionsFile := t.TempDir() + "/positions.yml"
+	ps, err := positions.New(log.NewNopLogger(), positions.Config{
+		SyncPeriod:    time.Hour,
+		PositionsFile: positionsFile,
+	})
+	require.NoError(t, err)
+	defer ps.Stop()
+
+	stopped := make(chan error, 1)
+	lifetime := 200 * time.Millisecond
+	entryHandler := fake.NewClient(func() {})
+	tgt, err := NewTarget(NewMetrics(prometheus.NewRegistry()), log.NewNopLogger(), entryHandler, ps, "flog", model.LabelSet{"job": "docker"}, nil, d.Client(), Options{
+		MaxLifetime: lifetime,
+		OnStop:      func(err error) { stopped <- err },
+	})
+	require.NoError(t, err)
+	start := time.Now()
+	tgt.StartIfNotRunning()
+	defer tgt.Stop()
+
+	select {
+	case err := <-stopped:
+		require.NoError(t, err)
+		require.GreaterOrEqual(t, time.Since(start), lifetime)
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "target wasn't stopped after its lifetime")
+	}
+	require.False(t, tgt.Ready())
+	require.Equal(t, StatusStopped, tgt.Status())
+	require.Len(t, entryHandler.Received(), 1)
+	require.Equal(t, "1702113417", ps.GetString(positions.CursorKey("flog"), tgt.LabelsStr()))
+
+	// The position was written to the positions file once the lifetime was
+	// over.
+	buf, err := os.ReadFile(positionsFile)
+	require.NoError(t, err)
+	var file positions.File
+	require.NoError(t, yaml.Unmarshal(buf, &file))
+	require.Equal(t, map[positions.Entry]string{
+		{Path: positions.CursorKey("flog"), Labels: tgt.LabelsStr()}: "1702113417",
+	}, file.Positions)
+	require.Eventually(t, func() bool {
+		return d.OpenStreams("flog") == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The target isn't started again once its lifetime is over.
+	tgt.StartIfNotRunning()
+	require.False(t, tgt.Ready())
+}
+
+func TestNewTargetInvalidRelabelConfig(t *testing.T) {
+	valid := labelMapRule("__meta_docker_container_name", "name")
+	tests := map[string]struct {
+		rc     *relabel.Config
+		expect string
+	}{
+		"nil config":            {rc: nil, expect: "invalid relabel config at index 1: relabel config cannot be nil"},
+		"unknown action":        {rc: &relabel.Config{Action: "rename", Regex: relabel.MustNewRegexp("(.*)")}, expect: `unknown relabel action "rename"`},
+		"empty action":          {rc: &relabel.Config{Regex: relabel.MustNewRegexp("(.*)")}, expect: "relabel action cannot be empty"},
+		"missing modulus":       {rc: &relabel.Config{Action: relabel.HashMod, Regex: relabel.MustNewRegexp("(.*)"), TargetLabel: "shard"}, expect: "requires non-zero modulus"},
+		"invalid target":        {rc: &relabel.Config{Action: relabel.Replace, Regex: relabel.MustNewRegexp("(.*)"), TargetLabel: "0name"}, expect: `"0name" is invalid 'target_label' for replace action`},
+		"invalid labelmap":      {rc: &relabel.Config{Action: relabel.LabelMap, Regex: relabel.MustNewRegexp("(.*)"), Replacement: "-"}, expect: `"-" is invalid 'replacement' for labelmap action`},
+		"lowercase replacement": {rc: &relabel.Config{Action: relabel.Lowercase, Regex: relabel.MustNewRegexp("(.*)"), SourceLabels: model.LabelNames{"job"}, TargetLabel: "job", Replacement: "x"}, expect: "'replacement' can not be set for lowercase action"},
+		"keepequal regex":       {rc: &relabel.Config{Action: relabel.KeepEqual, Regex: relabel.MustNewRegexp("a"), SourceLabels: model.LabelNames{"job"}, TargetLabel: "name"}, expect: "keepequal action requires only 'source_labels' and `target_label`"},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewTarget(nil, nil, nil, nil, "flog", nil, []*relabel.Config{valid, tc.rc}, nil, Options{})
+			require.ErrorContains(t, err, tc.expect)
+		})
+	}
+
+	// A rule without a regular expression gets the default one, as it would
+	// when loaded from YAML.
+	rc := &relabel.Config{Action: relabel.Keep, SourceLabels: model.LabelNames{"job"}}
+	rcs, err := validateRelabelConfigs([]*relabel.Config{rc})
+	require.NoError(t, err)
+	require.Equal(t, relabel.DefaultRelabelConfig.Regex, rcs[0].Regex)
+	require.Nil(t, rc.Regex.Regexp)
+}
+
+func TestNewTargetFlowRelabelConfig(t *testing.T) {
+	// Rules from Flow have every field set to its default, which must not be
+	// mistaken for fields set on actions which don't allow them.
+	for _, action := range []flow_relabel.Action{flow_relabel.KeepEqual, flow_relabel.DropEqual} {
+		var rc flow_relabel.Config
+		rc.SetToDefault()
+		rc.Action = action
+		rc.SourceLabels = []string{"job"}
+		rc.TargetLabel = "name"
+
+		_, err := validateRelabelConfigs(flow_relabel.ComponentToPromRelabelConfigs([]*flow_relabel.Config{&rc}))
+		require.NoError(t, err, action)
+	}
+}
+
+func TestDockerTargetLastFlushedPosition(t *testing.T) {
+	d := fakedocker.New(t)
+	d.AddContainer("flog", "/flog",
+		"2023-12-09T09:16:57.000000000Z first",
+		"2023-12-09T09:16:58.500000000Z last",
+	)
+
+	metrics := NewMetrics(prometheus.NewRegistry())
+	ps, err := positions.New(log.NewNopLogger(), positions.Config{
+		SyncPeriod:    time.Hour,
+		PositionsFile: t.TempDir() + "/positions.yml",
+		OnSave:        metrics.PositionsSaved,
+	})
+	require.NoError(t, err)
+	defer ps.Stop()
+
+	entryHandler := fake.NewClient(func() {})
+	tgt, err := NewTarget(metrics, log.NewNopLogger(), entryHandler, ps, "flog", model.LabelSet{"job": "docker"}, nil, d.Client(), Options{})
+	require.NoError(t, err)
+	tgt.StartIfNotRunning()
+	require.Eventually(t, func() bool {
+		return len(entryHandler.Received()) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The gauge is only set once the position was written.
+	require.Zero(t, testutil.CollectAndCount(metrics.dockerLastFlushedPositionTimestamp))
+	ps.(positions.Syncer).Sync()
+	gauge := metrics.dockerLastFlushedPositionTimestamp.WithLabelValues("flog")
+	last := entryHandler.Received()[1].Timestamp.Unix()
+	require.Equal(t, float64(last), testutil.ToFloat64(gauge))
+	require.Equal(t, strconv.FormatInt(last, 10), ps.GetString(positions.CursorKey("flog"), tgt.LabelsStr()))
+
+	// A running target of the same container with other labels shares the
+	// series, which is set to the latest position of both.
+	otherLabels := model.LabelSet{"job": "other"}
+	ps.Put(positions.CursorKey("flog"), otherLabels.String(), last+60)
+	other, err := NewTarget(metrics, log.NewNopLogger(), entryHandler, ps, "flog", otherLabels, nil, d.Client(), Options{})
+	require.NoError(t, err)
+	other.StartIfNotRunning()
+	defer other.Stop()
+	require.Eventually(t, func() bool {
+		ps.(positions.Syncer).Sync()
+		return testutil.ToFloat64(gauge) == float64(last+60)
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, 1, testutil.CollectAndCount(metrics.dockerLastFlushedPositionTimestamp))
+	require.Len(t, entryHandler.Received(), 2)
+
+	// The series is deleted once no target of the container is running, and
+	// isn't set again by later writes of the positions file.
+	tgt.Stop()
+	require.Equal(t, 1, testutil.CollectAndCount(metrics.dockerLastFlushedPositionTimestamp))
+	other.Stop()
+	require.Zero(t, testutil.CollectAndCount(metrics.dockerLastFlushedPositionTimestamp))
+	ps.(positions.Syncer).Sync()
+	require.Zero(t, testutil.CollectAndCount(metrics.dockerLastFlushedPositionTimestamp))
+	require.Equal(t, strconv.FormatInt(last, 10), ps.GetString(positions.CursorKey("flog"), tgt.LabelsStr()))
+}
+
+func TestDockerTargetMaxReconnects(t *testing.T) {
+	d := fakedocker.New(t)
+	d.AddContainer("flog", "/flog", "2023-12-09T09:16:57.000000000Z running")
+
+	stopped := make(chan error, 1)
+	tgt, _, _ := newTestTargetWithClient(t, d.Client(), "flog", Options{
+		MaxReconnects: 3,
+		OnStop:        func(err error) { stopped <- err },
+	})
+	tgt.StartIfNotRunning()
+	defer tgt.Stop()
+
+	for i := 0; i < 3; i++ {
+		tgt.Reconnect()
+		require.True(t, tgt.Ready())
+	}
+	require.Empty(t, stopped)
+
+	tgt.Reconnect()
+	require.False(t, tgt.Ready())
+	select {
+	case err := <-stopped:
+		require.EqualError(t, err, "reconnected to the log stream more than 3 times within 1m0s")
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "stop callback wasn't called")
+	}
+	require.Equal(t, "reconnected to the log stream more than 3 times within 1m0s", tgt.Details()["error"])
+	// The reconnect the target gave up on isn't counted.
+	require.Equal(t, 3.0, testutil.ToFloat64(tgt.metrics.dockerReconnects.WithLabelValues(reconnectReasonManual)))
+	require.Equal(t, uint64(3), tgt.MetricsSnapshot().Reconnects)
+}
+
+func TestDockerTargetMaxReconnectsRestarts(t *testing.T) {
+	d := fakedocker.New(t)
+	d.AddContainer("flog", "/flog", "2023-12-09T09:16:57.000000000Z running")
+
+	stopped := make(chan error, 1)
+	tgt, _, _ := newTestTargetWithClient(t, d.Client(), "flog", Options{
+		FollowRestarts: true,
+		MaxReconnects:  1,
+		OnStop:         func(err error) { stopped <- err },
+	})
+	tgt.StartIfNotRunning()
+	defer tgt.Stop()
+	require.Eventually(t, func() bool {
+		return len(d.Attaches("flog")) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Re-attaching to the restarted container counts as a reconnect.
+	start := time.Date(2023, time.December, 9, 9, 17, 0, 0, time.UTC)
+	d.Restart("flog", start)
+	require.Eventually(t, func() bool {
+		return len(d.Attaches("flog")) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, 1.0, testutil.ToFloat64(tgt.metrics.dockerReconnects.WithLabelValues(reconnectReasonRestart)))
+
+	d.Restart("flog", start.Add(time.Second))
+	select {
+	case err := <-stopped:
+		require.EqualError(t, err, "reconnected to the log stream more than 1 times within 1m0s")
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "stop callback wasn't called")
+	}
+	require.Eventually(t, func() bool { return !tgt.Ready() }, 5*time.Second, 10*time.Millisecond)
+	require.Len(t, d.Attaches("flog"), 2)
+	require.Equal(t, 1.0, testutil.ToFloat64(tgt.metrics.dockerReconnects.WithLabelValues(reconnectReasonRestart)))
+}
+
+func TestDockerTargetMinLevel(t *testing.T) {
+	d := fakedocker.New(t)
+	d.AddContainer("flog", "/flog",
+		`2023-12-09T09:16:57.000000000Z {"severity":"debug","msg":"dropped"}`,
+		`2023-12-09T09:16:57.100000000Z {"severity":"INFO","msg":"dropped"}`,
+		`2023-12-09T09:16:57.200000000Z {"severity":"warning","msg":"kept"}`,
+		`2023-12-09T09:16:57.300000000Z {"severity":"error","msg":"kept"}`,
+		`2023-12-09T09:16:57.400000000Z {"severity":"chatty","msg":"kept"}`,
+		`2023-12-09T09:16:57.500000000Z {"msg":"kept"}`,
+		`2023-12-09T09:16:57.600000000Z level=debug msg=kept`,
+	)
+
+	tgt, entryHandler, _ := newTestTargetWithClient(t, d.Client(), "flog", Options{MinLevel: "warn", LevelField: "severity"})
+	tgt.StartIfNotRunning()
+	defer tgt.Stop()
+
+	require.Eventually(t, func() bool {
+		return len(entryHandler.Received()) == 5
+	}, 5*time.Second, 10*time.Millisecond)
+	for _, entry := range entryHandler.Received() {
+		require.Contains(t, entry.Line, "kept")
+	}
+	require.Equal(t, 2.0, testutil.ToFloat64(tgt.metrics.dockerLevelFiltered))
+
+	_, err := NewTarget(nil, nil, nil, nil, "flog", nil, nil, nil, Options{MinLevel: "loud"})
+	require.EqualError(t, err, `unknown minimum level "loud"`)
+}
+
+func TestDockerTargetPositionsSyncEntries(t *testing.T) {
+	d := fakedocker.New(t)
+	d.AddContainer("flog", "/flog")
+
+	positionsFile := t.TempDir() + "/positions.yml"
+	ps, err := positions.New(log.NewNopLogger(), positions.Config{
+		SyncPeriod:    time.Hour,
+		PositionsFile: positionsFile,
+	})
+	require.NoError(t, err)
+	defer ps.Stop()
+
+	entryHandler := fake.NewClient(func() {})
+	tgt, err := NewTarget(NewMetrics(prometheus.NewRegistry()), log.NewNopLogger(), entryHandler, ps, "flog", model.LabelSet{"job": "docker"}, nil, d.Client(), Options{
+		PositionsSyncEntries: 2,
+	})
+	require.NoError(t, err)
+
+	// Lines are only sent to log streams opened after they were added, so the
+	// target reconnects to read each of them.
+	tgt.StartIfNotRunning()
+	start := time.Date(2023, 12, 9, 9, 16, 57, 0, time.UTC)
+	for i := 1; i <= 5; i++ {
+		d.AppendLines("flog", start.Add(time.Duration(i)*time.Second).Format(time.RFC3339Nano)+" line "+strconv.Itoa(i))
+		tgt.Reconnect()
+		require.Eventually(t, func() bool {
+			return len(entryHandler.Received()) == i
+		}, 5*time.Second, 10*time.Millisecond)
+
+		// The positions file is written after every second entry only.
+		if i < 2 {
+			_, err := os.Stat(positionsFile)
+			require.ErrorIs(t, err, os.ErrNotExist)
+			continue
+		}
+		synced := start.Add(time.Duration(i-i%2) * time.Second).Unix()
+		require.Eventually(t, func() bool {
+			buf, err := os.ReadFile(positionsFile)
+			return err == nil && strings.Contains(string(buf), strconv.FormatInt(synced, 10))
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+	tgt.Stop()
+}
+
+func TestDockerTargetTail(t *testing.T) {
+	d := fakedocker.New(t)
+	d.AddContainer("flog", "/flog",
+		"2023-12-09T09:16:57.000000000Z 1",
+		"2023-12-09T09:16:58.000000000Z 2",
+		"2023-12-09T09:16:59.000000000Z 3",
+	)
+
+	// Without a position, only the most recent lines are read.
+	tgt, entryHandler, ps := newTestTargetWithClient(t, d.Client(), "flog", Options{Tail: 2})
+	tgt.StartIfNotRunning()
+	require.Eventually(t, func() bool {
+		return len(entryHandler.Received()) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, "2", entryHandler.Received()[0].Line)
+	require.Equal(t, "3", entryHandler.Received()[1].Line)
+	tgt.Stop()
+
+	// With a position, the log stream is read from it regardless of Tail.
+	ps.Put(positions.CursorKey("flog"), tgt.LabelsStr(), time.Date(2023, 12, 9, 9, 16, 57, 0, time.UTC).Unix())
+	tgt, err := NewTarget(tgt.metrics, log.NewNopLogger(), entryHandler, ps, "flog", tgt.labels, nil, d.Client(), Options{Tail: 1})
+	require.NoError(t, err)
+	entryHandler.Clear()
+	tgt.StartIfNotRunning()
+	defer tgt.Stop()
+	require.Eventually(t, func() bool {
+		return len(entryHandler.Received()) == 3
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, "1", entryHandler.Received()[0].Line)
+}
+
+func TestDockerTargetAnnotateGeneration(t *testing.T) {
+	d := fakedocker.New(t)
+	d.AddContainer("flog", "/flog", "2023-12-09T09:16:57.000000000Z before")
+
+	tgt, entryHandler, _ := newTestTargetWithClient(t, d.Client(), "flog", Options{AnnotateGeneration: true})
+	tgt.StartIfNotRunning()
+	defer tgt.Stop()
+	require.Eventually(t, func() bool {
+		return len(entryHandler.Received()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	d.AppendLines("flog", "2023-12-09T09:16:58.000000000Z after")
+	tgt.Reconnect()
+	require.Eventually(t, func() bool {
+		return len(entryHandler.Received()) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	received := entryHandler.Received()
+	require.Equal(t, "before", received[0].Line)
+	require.Equal(t, push.LabelsAdapter{{Name: metadataReconnectGeneration, Value: "1"}}, received[0].StructuredMetadata)
+	require.Equal(t, "after", received[1].Line)
+	require.Equal(t, push.LabelsAdapter{{Name: metadataReconnectGeneration, Value: "2"}}, received[1].StructuredMetadata)
+	require.Equal(t, uint64(2), tgt.ExportState().Generation)
+}
+
+func TestDockerTargetAnnotateStartPosition(t *testing.T) {
+	d := fakedocker.New(t)
+	d.AddContainer("flog", "/flog", "2023-12-09T09:16:57.500000000Z before")
+
+	tgt, entryHandler, _ := newTestTargetWithClient(t, d.Client(), "flog", Options{
+		AnnotateStartPosition: true,
+		FollowRestarts:        true,
+		AttachPollInterval:    10 * time.Millisecond,
+	})
+	tgt.StartIfNotRunning()
+	defer tgt.Stop()
+	require.Eventually(t, func() bool {
+		return len(entryHandler.Received()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// After the restart, the log stream is read from the position of the
+	// last entry.
+	d.AppendLines("flog", "2023-12-09T09:16:58.000000000Z after")
+	d.Restart("flog", time.Now())
+	require.Eventually(t, func() bool {
+		return len(entryHandler.Received()) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	received := entryHandler.Received()
+	require.Equal(t, "before", received[0].Line)
+	require.Equal(t, push.LabelsAdapter{{Name: metadataStartPosition, Value: "0"}}, received[0].StructuredMetadata)
+	require.Equal(t, "after", received[1].Line)
+	since := strconv.FormatInt(time.Date(2023, 12, 9, 9, 16, 57, 0, time.UTC).Unix(), 10)
+	require.Equal(t, push.LabelsAdapter{{Name: metadataStartPosition, Value: since}}, received[1].StructuredMetadata)
+}
+
+func TestDockerTargetEventsResubscribe(t *testing.T) {
+	d := fakedocker.New(t)
+	d.AddContainer("db", "/db-1", "2023-12-09T09:16:57.000000000Z from db")
+
+	tgt, entryHandler, _ := newTestTargetWithClient(t, d.Client(), "db", Options{
+		NameGlob:           "web-*",
+		AttachPollInterval: 20 * time.Millisecond,
+	})
+	tgt.StartIfNotRunning()
+	defer tgt.Stop()
+	require.Eventually(t, func() bool { return d.EventRequests() == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	// The container is renamed while the connection to the daemon is lost, so
+	// its event is missed.
+	d.FailEvents(2)
+	d.UpdateInfo("db", func(info *types.ContainerJSON) { info.Name = "/web-2" })
+
+	// The target re-evaluates the attach conditions when resubscribing.
+	require.Eventually(t, func() bool {
+		return len(entryHandler.Received()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Events are received again once the daemon is back.
+	require.Eventually(t, func() bool { return d.EventRequests() == 4 }, 5*time.Second, 10*time.Millisecond)
+	d.Rename("db", "/db-1")
+	require.Eventually(t, func() bool {
+		return d.OpenStreams("db") == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	require.True(t, tgt.Ready())
+}
+
+func TestDockerTargetNameGlob(t *testing.T) {
+	d := fakedocker.New(t)
+	d.AddContainer("web", "/web-1", "2023-12-09T09:16:57.000000000Z from web")
+	d.AddContainer("db", "/db-1", "2023-12-09T09:16:57.000000000Z from db")
+
+	opts := Options{NameGlob: "web-*"}
+	web, webHandler, _ := newTestTargetWithClient(t, d.Client(), "web", opts)
+	db, dbHandler, _ := newTestTargetWithClient(t, d.Client(), "db", opts)
+	web.StartIfNotRunning()
+	defer web.Stop()
+	db.StartIfNotRunning()
+	defer db.Stop()
+
+	require.Eventually(t, func() bool {
+		return len(webHandler.Received()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, "from web", webHandler.Received()[0].Line)
+	require.Empty(t, dbHandler.Received())
+	require.True(t, db.Ready(), "a filtered target keeps waiting for changes")
+
+	// Renaming the container makes it match the glob.
+	d.Rename("db", "/web-2")
+	require.Eventually(t, func() bool {
+		return len(dbHandler.Received()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, "from db", dbHandler.Received()[0].Line)
+
+	// Renaming it back detaches from the container.
+	d.Rename("db", "/db-1")
+	require.Eventually(t, func() bool {
+		return d.OpenStreams("db") == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestDockerTargetHealthStatus(t *testing.T) {
+	d := fakedocker.New(t)
+	d.AddContainer("web", "/web", "2023-12-09T09:16:57.000000000Z connection refused")
+	d.SetHealth("web", types.Healthy)
+
+	tgt, entryHandler, _ := newTestTargetWithClient(t, d.Client(), "web", Options{HealthStatus: types.Unhealthy})
+	tgt.StartIfNotRunning()
+	defer tgt.Stop()
+
+	require.Eventually(t, func() bool {
+		return tgt.Status() == StatusWaiting
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Empty(t, entryHandler.Received())
+	require.Zero(t, d.OpenStreams("web"))
+
+	// Becoming unhealthy attaches to the container, from the time of the
+	// change, so that the lines logged before it aren't sent.
+	d.SetHealth("web", types.Unhealthy)
+	d.AppendLines("web", time.Now().UTC().Format(time.RFC3339Nano)+" database unreachable")
+	require.Eventually(t, func() bool {
+		return len(entryHandler.Received()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, "database unreachable", entryHandler.Received()[0].Line)
+	require.Equal(t, 1, d.OpenStreams("web"))
+
+	// Becoming healthy again detaches from it.
+	d.SetHealth("web", types.Healthy)
+	require.Eventually(t, func() bool {
+		return d.OpenStreams("web") == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestDockerTargetDetachOnPause(t *testing.T) {
+	d := fakedocker.New(t)
+	d.AddContainer("web", "/web", "2023-12-09T09:16:57Z before pause")
+
+	tgt, entryHandler, _ := newTestTargetWithClient(t, d.Client(), "web", Options{DetachOnPause: true})
+	tgt.StartIfNotRunning()
+	defer tgt.Stop()
+
+	require.Eventually(t, func() bool {
+		return len(entryHandler.Received()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, StatusReading, tgt.Status())
+
+	// Pausing the container detaches from it without stopping the target.
+	d.SetPaused("web", true)
+	require.Eventually(t, func() bool {
+		return tgt.Status() == StatusContainerPaused && d.OpenStreams("web") == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	require.True(t, tgt.Ready())
+
+	// Unpausing it resumes reading from the last position.
+	d.AppendLines("web", "2023-12-09T09:16:58Z after pause")
+	d.SetPaused("web", false)
+	require.Eventually(t, func() bool {
+		return len(entryHandler.Received()) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, "after pause", entryHandler.Received()[1].Line)
+	require.Equal(t, StatusReading, tgt.Status())
+	require.Equal(t, 1, d.OpenStreams("web"))
+}
+
+func TestDockerTargetInspectRetries(t *testing.T) {
+	d := fakedocker.New(t)
+	d.AddContainer("flog", "/flog", "2023-12-09T09:16:57Z started")
+	d.FailInspects("flog", 2)
+
+	tgt, entryHandler, _ := newTestTargetWithClient(t, d.Client(), "flog", Options{InspectBackoff: 10 * time.Millisecond})
+	tgt.StartIfNotRunning()
+	defer tgt.Stop()
+
+	require.Eventually(t, func() bool {
+		return len(entryHandler.Received()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, 3, d.Inspects("flog"))
+
+	// The target gives up once the retries are exhausted.
+	d.FailInspects("flog", 3)
+	stopped := make(chan error, 1)
+	failing, _, _ := newTestTargetWithClient(t, d.Client(), "flog", Options{
+		InspectRetries: 2,
+		InspectBackoff: 10 * time.Millisecond,
+		OnStop:         func(err error) { stopped <- err },
+	})
+	failing.StartIfNotRunning()
+	defer failing.Stop()
+	select {
+	case err := <-stopped:
+		require.ErrorContains(t, err, "container is starting")
+	case <-time.After(5 * time.Second):
+		t.Fatal("target did not stop")
+	}
+	require.Equal(t, 6, d.Inspects("flog"))
+}
+
+func TestDockerTargetUser(t *testing.T) {
+	d := fakedocker.New(t)
+	d.AddContainer("app", "/app", "2023-12-09T09:16:57Z from app")
+	d.AddContainer("root", "/root", "2023-12-09T09:16:57Z from root")
+	d.AddContainer("group", "/group", "2023-12-09T09:16:57Z from group")
+	d.UpdateInfo("app", func(info *types.ContainerJSON) { info.Config.User = "1000" })
+	d.UpdateInfo("group", func(info *types.ContainerJSON) { info.Config.User = "1000:1000" })
+
+	rcs := []*relabel.Config{labelMapRule(dockerLabelContainerUser, "user")}
+	opts := Options{User: "1000"}
+	app, appHandler, _ := newTestTargetWithRelabel(t, d.Client(), "app", rcs, opts)
+	root, rootHandler, _ := newTestTargetWithRelabel(t, d.Client(), "root", rcs, opts)
+	group, groupHandler, _ := newTestTargetWithRelabel(t, d.Client(), "group", rcs, opts)
+	for _, tgt := range []*Target{app, root, group} {
+		tgt.StartIfNotRunning()
+		defer tgt.Stop()
+	}
+
+	require.Eventually(t, func() bool {
+		return len(appHandler.Received()) == 1 && len(groupHandler.Received()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, model.LabelValue("1000"), appHandler.Received()[0].Labels["user"])
+	require.Equal(t, model.LabelValue("1000:1000"), groupHandler.Received()[0].Labels["user"])
+	require.Empty(t, rootHandler.Received())
+	require.Zero(t, d.OpenStreams("root"))
+}
+
+func TestDockerTargetRefreshDebounce(t *testing.T) {
+	d := fakedocker.New(t)
+	d.AddContainer("web", "/web-1", "2023-12-09T09:16:57.000000000Z from web")
+
+	tgt, entryHandler, _ := newTestTargetWithClient(t, d.Client(), "web", Options{
+		NameGlob:        "web-*",
+		RefreshDebounce: 100 * time.Millisecond,
+	})
+	tgt.StartIfNotRunning()
+	defer tgt.Stop()
+	require.Eventually(t, func() bool {
+		return len(entryHandler.Received()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	inspects := d.Inspects("web")
+
+	for i := 0; i < 5; i++ {
+		d.Rename("web", "/web-"+strconv.Itoa(i+2))
+	}
+	require.Eventually(t, func() bool {
+		return d.Inspects("web") > inspects
+	}, 5*time.Second, 10*time.Millisecond)
+	time.Sleep(300 * time.Millisecond)
+	require.Equal(t, inspects+1, d.Inspects("web"))
+}
+
+func TestDockerTargetRecentEntries(t *testing.T) {
+	lines := make([]string, 5)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("2023-12-09T09:16:5%dZ line %d", i, i)
+	}
+	d := fakedocker.New(t)
+	d.AddContainer("flog", "/flog", lines...)
+
+	tgt, entryHandler, _ := newTestTargetWithClient(t, d.Client(), "flog", Options{RecentEntriesSize: 3})
+	require.Empty(t, tgt.RecentEntries(3))
+
+	tgt.StartIfNotRunning()
+	defer tgt.Stop()
+	require.Eventually(t, func() bool {
+		return len(entryHandler.Received()) == len(lines)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	recentLines := func(n int) []string {
+		var res []string
+		for _, e := range tgt.RecentEntries(n) {
+			res = append(res, e.Line)
+		}
+		return res
+	}
+	require.Equal(t, []string{"line 3", "line 4"}, recentLines(2))
+	require.Equal(t, []string{"line 2", "line 3", "line 4"}, recentLines(10))
+}
+
+func TestDockerTargetAwaitingFirstLine(t *testing.T) {
+	d := fakedocker.New(t)
+	d.AddContainer("silent", "/silent")
+
+	tgt, _, _ := newTestTargetWithClient(t, d.Client(), "silent", Options{NoLogsYetTimeout: 10 * time.Millisecond})
+	require.Equal(t, StatusStopped, tgt.Status())
+
+	tgt.StartIfNotRunning()
+	require.Eventually(t, func() bool {
+		return tgt.Status() == StatusAwaitingFirstLine
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, string(StatusAwaitingFirstLine), tgt.Details()["status"])
+
+	tgt.Stop()
+	require.Equal(t, StatusStopped, tgt.Status())
+}
+
+func TestDockerTargetMaxBatchSize(t *testing.T) {
+	lines := make([]string, 50)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("2023-12-09T09:16:57.%09dZ line %d", i, i)
+	}
+	d := fakedocker.New(t)
+	d.AddContainer("flog", "/flog", lines...)
+
+	var (
+		mut      sync.Mutex
+		batches  int
+		maxSize  int
+		received []string
+	)
+	opts := Options{
+		MaxBatchSize: 4,
+		BatchHandler: func(entries []loki.Entry) {
+			mut.Lock()
+			defer mut.Unlock()
+			if len(entries) > maxSize {
+				maxSize = len(entries)
+			}
+			batches++
+			for _, e := range entries {
+				received = append(received, e.Line)
+			}
+		},
+	}
+	tgt, entryHandler, _ := newTestTargetWithClient(t, d.Client(), "flog", opts)
+	tgt.StartIfNotRunning()
+	defer tgt.Stop()
+
+	require.Eventually(t, func() bool {
+		mut.Lock()
+		defer mut.Unlock()
+		return len(received) == len(lines)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	mut.Lock()
+	defer mut.Unlock()
+	for i, line := range received {
+		require.Equal(t, fmt.Sprintf("line %d", i), line)
+	}
+	require.LessOrEqual(t, maxSize, 4)
+	require.GreaterOrEqual(t, batches, len(lines)/4)
+	require.Empty(t, entryHandler.Received())
+}
+
+func TestDockerTargetMaxBatchSizeFlush(t *testing.T) {
+	for name, tc := range map[string]struct {
+		maxWait time.Duration
+		end     bool
+	}{
+		// Held back entries are flushed once no more lines arrived in time.
+		"timeout": {maxWait: 50 * time.Millisecond},
+		// Held back entries are flushed once the log stream ends.
+		"stream end": {maxWait: time.Hour, end: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			d := fakedocker.New(t)
+			d.AddContainer("flog", "/flog",
+				"2023-12-09T09:16:57.000000000Z START a",
+				"2023-12-09T09:16:57.100000000Z START b \\",
+			)
+
+			var (
+				mut      sync.Mutex
+				maxSize  int
+				received []string
+			)
+			tgt, _, _ := newTestTargetWithClient(t, d.Client(), "flog", Options{
+				ContinuationMarker: `\`,
+				MultilineFirstLine: `^START`,
+				MultilineMaxWait:   tc.maxWait,
+				MaxBatchSize:       1,
+				BatchHandler: func(entries []loki.Entry) {
+					mut.Lock()
+					defer mut.Unlock()
+					maxSize = max(maxSize, len(entries))
+					for _, e := range entries {
+						received = append(received, e.Line)
+					}
+				},
+			})
+			tgt.StartIfNotRunning()
+			defer tgt.Stop()
+			if tc.end {
+				require.Eventually(t, func() bool { return d.OpenStreams("flog") == 1 }, 5*time.Second, 10*time.Millisecond)
+				d.Restart("flog", time.Now())
+			}
+
+			require.Eventually(t, func() bool {
+				mut.Lock()
+				defer mut.Unlock()
+				return len(received) == 2
+			}, 5*time.Second, 10*time.Millisecond)
+			mut.Lock()
+			defer mut.Unlock()
+			require.Equal(t, []string{"START a", "START b "}, received)
+			require.Equal(t, 1, maxSize)
+		})
+	}
+}
+
+func TestDockerTargetResourceLimitLabels(t *testing.T) {
+	d := fakedocker.New(t)
+	d.AddContainer("limited", "/limited", "2023-12-09T09:16:57Z limited")
+	d.AddContainer("unlimited", "/unlimited", "2023-12-09T09:16:57Z unlimited")
+	d.UpdateInfo("limited", func(info *types.ContainerJSON) {
+		info.HostConfig = &container.HostConfig{
+			Resources: container.Resources{Memory: 512 * 1024 * 1024, CPUShares: 512},
+		}
+	})
+
+	rcs := []*relabel.Config{
+		labelMapRule(dockerLabelContainerMemoryLimit, "memory_limit"),
+		labelMapRule(dockerLabelContainerCPUShares, "cpu_shares"),
+	}
+	for id, expected := range map[string]model.LabelSet{
+		"limited":   {"job": "docker", "memory_limit": "536870912", "cpu_shares": "512"},
+		"unlimited": {"job": "docker"},
+	} {
+		tgt, entryHandler, _ := newTestTargetWithRelabel(t, d.Client(), id, rcs, Options{})
+		tgt.StartIfNotRunning()
+		require.Eventually(t, func() bool {
+			return len(entryHandler.Received()) == 1
+		}, 5*time.Second, 10*time.Millisecond)
+		tgt.Stop()
+
+		require.Equal(t, expected, entryHandler.Received()[0].Labels, id)
+	}
+}
+
+func TestDockerTargetPIDLabel(t *testing.T) {
+	d := fakedocker.New(t)
+	d.AddContainer("flog", "/flog", "2023-12-09T09:16:57Z flog")
+	d.UpdateInfo("flog", func(info *types.ContainerJSON) {
+		info.State = &types.ContainerState{Running: true, Pid: 4242}
+	})
+
+	rcs := []*relabel.Config{labelMapRule(dockerLabelContainerPID, "pid")}
+	tgt, entryHandler, _ := newTestTargetWithRelabel(t, d.Client(), "flog", rcs, Options{})
+	tgt.StartIfNotRunning()
+	defer tgt.Stop()
+
+	require.Eventually(t, func() bool {
+		return len(entryHandler.Received()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, model.LabelValue("4242"), entryHandler.Received()[0].Labels["pid"])
+}
+
+func TestDockerTargetLogTagLabel(t *testing.T) {
+	d := fakedocker.New(t)
+	d.AddContainer("0123456789abcdef", "/web", "2023-12-09T09:16:57Z web")
+	d.AddContainer("untagged", "/untagged", "2023-12-09T09:16:57Z untagged")
+	d.UpdateInfo("0123456789abcdef", func(info *types.ContainerJSON) {
+		info.Config.Image = "nginx:1.25"
+		info.HostConfig = &container.HostConfig{
+			LogConfig: container.LogConfig{
+				Type:   "json-file",
+				Config: map[string]string{"tag": "{{.ImageName}}/{{.Name}}/{{.ID}}"},
+			},
+		}
+	})
+
+	rcs := []*relabel.Config{labelMapRule(dockerLabelContainerLogTag, "tag")}
+	tagged, taggedHandler, _ := newTestTargetWithRelabel(t, d.Client(), "0123456789abcdef", rcs, Options{})
+	untagged, untaggedHandler, _ := newTestTargetWithRelabel(t, d.Client(), "untagged", rcs, Options{})
+	for _, tgt := range []*Target{tagged, untagged} {
+		tgt.StartIfNotRunning()
+		defer tgt.Stop()
+	}
+
+	require.Eventually(t, func() bool {
+		return len(taggedHandler.Received()) == 1 && len(untaggedHandler.Received()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, model.LabelValue("nginx:1.25/web/0123456789ab"), taggedHandler.Received()[0].Labels["tag"])
+	require.NotContains(t, untaggedHandler.Received()[0].Labels, model.LabelName("tag"))
+}
+
+func TestDockerTargetLogTimestampPrecisionLabel(t *testing.T) {
+	d := fakedocker.New(t)
+	drivers := map[string]container.LogConfig{
+		"json-file": {Type: "json-file"},
+		"journald":  {Type: "journald"},
+		"syslog":    {Type: "syslog"},
+		"uncached":  {Type: "syslog", Config: map[string]string{"cache-disabled": "true"}},
+		"none":      {Type: "none"},
+	}
+	for id, logConfig := range drivers {
+		d.AddContainer(id, "/"+id, "2023-12-09T09:16:57Z "+id)
+		d.UpdateInfo(id, func(info *types.ContainerJSON) {
+			info.HostConfig = &container.HostConfig{LogConfig: logConfig}
+		})
+	}
+
+	rcs := []*relabel.Config{labelMapRule(dockerLabelContainerLogTimestampPrecision, "precision")}
+	for id, expected := range map[string]model.LabelValue{
+		"json-file": "nanosecond",
+		"journald":  "microsecond",
+		"syslog":    "nanosecond",
+		"uncached":  "",
+		"none":      "",
+	} {
+		tgt, entryHandler, _ := newTestTargetWithRelabel(t, d.Client(), id, rcs, Options{})
+		tgt.StartIfNotRunning()
+		require.Eventually(t, func() bool {
+			return len(entryHandler.Received()) == 1
+		}, 5*time.Second, 10*time.Millisecond)
+		tgt.Stop()
+
+		require.Equal(t, expected, entryHandler.Received()[0].Labels["precision"], id)
+	}
+}
+
+func TestDockerTargetPlatformLabels(t *testing.T) {
+	d := fakedocker.New(t)
+	d.AddImage(types.ImageInspect{ID: "sha256:arm", Os: "linux", Architecture: "arm64", Variant: "v8"})
+	d.AddContainer("arm", "/arm", "2023-12-09T09:16:57Z arm")
+	d.AddContainer("unknown-image", "/unknown-image", "2023-12-09T09:16:57Z unknown")
+	d.UpdateInfo("arm", func(info *types.ContainerJSON) {
+		info.Image = "sha256:arm"
+		info.Platform = "linux"
+	})
+	d.UpdateInfo("unknown-image", func(info *types.ContainerJSON) {
+		info.Image = "sha256:missing"
+		info.Platform = "windows"
+	})
+
+	rcs := []*relabel.Config{
+		labelMapRule(dockerLabelContainerOS, "os"),
+		labelMapRule(dockerLabelContainerArch, "arch"),
+	}
+	for id, expected := range map[string]model.LabelSet{
+		"arm":           {"job": "docker", "os": "linux", "arch": "arm64/v8"},
+		"unknown-image": {"job": "docker", "os": "windows"},
+	} {
+		tgt, entryHandler, _ := newTestTargetWithRelabel(t, d.Client(), id, rcs, Options{PlatformLabels: true})
+		tgt.StartIfNotRunning()
+		require.Eventually(t, func() bool {
+			return len(entryHandler.Received()) == 1
+		}, 5*time.Second, 10*time.Millisecond)
+		tgt.Stop()
+
+		require.Equal(t, expected, entryHandler.Received()[0].Labels, id)
+	}
+}
+
+func TestDockerTargetNullBytePolicy(t *testing.T) {
+	d := fakedocker.New(t)
+	d.AddContainer("flog", "/flog",
+		"2023-12-09T09:16:57.000000000Z before\x00after",
+		"2023-12-09T09:16:58.000000000Z clean",
+	)
+
+	for _, tc := range []struct {
+		opts     Options
+		expected []string
+	}{
+		{opts: Options{}, expected: []string{"before\uFFFDafter", "clean"}},
+		{opts: Options{NullBytePolicy: NullBytePolicyReplace, NullByteReplacement: `\0`}, expected: []string{`before\0after`, "clean"}},
+		{opts: Options{NullBytePolicy: NullBytePolicyStrip}, expected: []string{"beforeafter", "clean"}},
+		{opts: Options{NullBytePolicy: NullBytePolicyDrop}, expected: []string{"clean"}},
+	} {
+		tgt, entryHandler, _ := newTestTargetWithClient(t, d.Client(), "flog", tc.opts)
+		tgt.StartIfNotRunning()
+		require.Eventually(t, func() bool {
+			return len(entryHandler.Received()) == len(tc.expected)
+		}, 5*time.Second, 10*time.Millisecond)
+		tgt.Stop()
+
+		var lines []string
+		for _, entry := range entryHandler.Received() {
+			lines = append(lines, entry.Line)
+		}
+		require.Equal(t, tc.expected, lines, tc.opts.NullBytePolicy)
+		require.Equal(t, 1.0, testutil.ToFloat64(tgt.metrics.dockerNullBytes), tc.opts.NullBytePolicy)
+	}
+
+	_, err := NewTarget(nil, nil, nil, nil, "flog", nil, nil, nil, Options{NullBytePolicy: "escape"})
+	require.EqualError(t, err, `unknown null byte policy "escape"`)
+}
+
+func TestDockerTargetLabelRateLimiter(t *testing.T) {
+	d := fakedocker.New(t)
+	d.AddContainer("flog", "/flog",
+		"2023-12-09T09:16:57.000000000Z out 1",
+		"2023-12-09T09:16:57.100000000Z out 2",
+		"2023-12-09T09:16:57.200000000Z out 3",
+		"2023-12-09T09:16:57.300000000Z out 4",
+		"2023-12-09T09:16:57.400000000Z out 5",
+	)
+	d.AppendStderrLines("flog",
+		"2023-12-09T09:16:57.050000000Z err 1",
+		"2023-12-09T09:16:57.150000000Z err 2",
+		"2023-12-09T09:16:57.250000000Z err 3",
+	)
+
+	// Each log stream has its own value of the label, and thus its own limit,
+	// within the same target.
+	rcs := []*relabel.Config{labelMapRule(dockerLabelLogStream, "stream")}
+	limiter := NewLabelRateLimiter("stream", rate.Limit(0.001), 2)
+	tgt, entryHandler, _ := newTestTargetWithRelabel(t, d.Client(), "flog", rcs, Options{LabelRateLimiter: limiter})
+	tgt.StartIfNotRunning()
+	defer tgt.Stop()
+
+	limited := tgt.metrics.dockerLabelRateLimited
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(limited) == 4
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool {
+		return len(entryHandler.Received()) == 4
+	}, 5*time.Second, 10*time.Millisecond)
+
+	var lines []string
+	for _, entry := range entryHandler.Received() {
+		lines = append(lines, entry.Line)
+	}
+	sort.Strings(lines)
+	require.Equal(t, []string{"err 1", "err 2", "out 1", "out 2"}, lines)
+	require.Equal(t, uint64(4), tgt.MetricsSnapshot().Dropped)
+}
+
+func TestLabelRateLimiterEvictsFullBuckets(t *testing.T) {
+	// Buckets take two sweep intervals to refill.
+	limiter := NewLabelRateLimiter("service", rate.Every(2*labelLimiterSweepInterval), 1)
+	now := time.Date(2023, 12, 9, 9, 16, 57, 0, time.UTC)
+
+	require.True(t, limiter.allow(model.LabelSet{"service": "a"}, now))
+
+	// Buckets which aren't full yet are kept, so that their limit holds.
+	now = now.Add(labelLimiterSweepInterval)
+	require.True(t, limiter.allow(model.LabelSet{"service": "b"}, now))
+	require.False(t, limiter.allow(model.LabelSet{"service": "a"}, now))
+	require.Len(t, limiter.limiters, 2)
+
+	// Once refilled, the buckets of values no longer seen are evicted.
+	now = now.Add(2 * labelLimiterSweepInterval)
+	require.True(t, limiter.allow(model.LabelSet{"service": "c"}, now))
+	require.Len(t, limiter.limiters, 1)
+	require.Contains(t, limiter.limiters, model.LabelValue("c"))
+}
+
+func TestDockerTargetMetaLabelFunc(t *testing.T) {
+	d := fakedocker.New(t)
+	d.AddContainer("web", "/web", "2023-12-09T09:16:57Z web")
+	d.UpdateInfo("web", func(info *types.ContainerJSON) {
+		info.Config.Image = "nginx:1.25"
+		info.Config.Labels = map[string]string{"com.example.team": "edge"}
+		info.State = &types.ContainerState{Pid: 42}
+	})
+
+	metaFunc := func(info types.ContainerJSON) model.LabelSet {
+		return model.LabelSet{
+			"__meta_owner":          model.LabelValue(info.Config.Labels["com.example.team"] + "/" + info.Config.Image),
+			dockerLabelContainerPID: "0",
+		}
+	}
+	rcs := []*relabel.Config{
+		labelMapRule("__meta_owner", "owner"),
+		labelMapRule(dockerLabelContainerPID, "pid"),
+	}
+	tgt, entryHandler, _ := newTestTargetWithRelabel(t, d.Client(), "web", rcs, Options{MetaLabelFunc: metaFunc})
+	tgt.StartIfNotRunning()
+	defer tgt.Stop()
+
+	require.Eventually(t, func() bool {
+		return len(entryHandler.Received()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	labels := entryHandler.Received()[0].Labels
+	require.Equal(t, model.LabelValue("edge/nginx:1.25"), labels["owner"])
+	require.Equal(t, model.LabelValue("42"), labels["pid"], "built-in meta labels take precedence")
+}
+
+func TestDockerTargetFollowRestartsStreamEnded(t *testing.T) {
+	d := fakedocker.New(t)
+	d.AddContainer("flog", "/flog", "2023-12-09T09:16:57.000000000Z before")
+	d.UpdateInfo("flog", func(info *types.ContainerJSON) {
+		info.State = &types.ContainerState{Running: true, StartedAt: "2023-12-09T09:00:00Z"}
+	})
+
+	tgt, entryHandler, _ := newTestTargetWithClient(t, d.Client(), "flog", Options{
+		FollowRestarts:     true,
+		AttachPollInterval: 20 * time.Millisecond,
+	})
+	tgt.StartIfNotRunning()
+	defer tgt.Stop()
+	require.Eventually(t, func() bool {
+		return len(entryHandler.Received()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The log stream ends while the container keeps running, so the target
+	// re-attaches from its position rather than waiting for a restart.
+	d.AppendLines("flog", "2023-12-09T09:16:58.000000000Z after")
+	d.EndStreams("flog")
+	require.Eventually(t, func() bool {
+		return len(entryHandler.Received()) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, "after", entryHandler.Received()[1].Line)
+	require.Len(t, d.Attaches("flog"), 2)
+	require.Equal(t, 1.0, testutil.ToFloat64(tgt.metrics.dockerReconnects.WithLabelValues(reconnectReasonStreamEnded)))
+}
+
+func TestDockerTargetRestartLoop(t *testing.T) {
+	d := fakedocker.New(t)
+	d.AddContainer("flog", "/flog", "2023-12-09T09:16:57Z flog")
+
+	const backoff = 100 * time.Millisecond
+	tgt, _, _ := newTestTargetWithClient(t, d.Client(), "flog", Options{
+		FollowRestarts:       true,
+		RestartLoopThreshold: 2,
+		RestartBackoffMin:    backoff,
+		RestartBackoffMax:    time.Second,
+	})
+	tgt.StartIfNotRunning()
+	defer tgt.Stop()
+
+	require.Eventually(t, func() bool {
+		return len(d.Attaches("flog")) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Restart the container as soon as the target re-attached to it.
+	start := time.Date(2023, time.December, 9, 9, 17, 0, 0, time.UTC)
+	for i := 1; i <= 4; i++ {
+		d.Restart("flog", start.Add(time.Duration(i)*time.Second))
+		require.Eventually(t, func() bool {
+			return len(d.Attaches("flog")) == i+1
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+	require.True(t, tgt.Ready())
+
+	// The first two restarts are tolerated, the ones after are delayed with an
+	// increasing backoff.
+	attaches := d.Attaches("flog")
+	require.GreaterOrEqual(t, attaches[3].Sub(attaches[2]), backoff)
+	require.GreaterOrEqual(t, attaches[4].Sub(attaches[3]), 2*backoff)
+	require.Equal(t, 2.0, testutil.ToFloat64(tgt.metrics.dockerRestartThrottled))
+}
+
+func TestDockerTargetLabelsAsMetadata(t *testing.T) {
+	d := fakedocker.New(t)
+	d.AddContainer("flog", "/flog", "2023-12-09T09:16:57Z flog")
+	d.UpdateInfo("flog", func(info *types.ContainerJSON) {
+		info.Config.Labels = map[string]string{
+			"com.docker.compose.project": "shop",
+			"description":                "käsekuchen",
+			"zz.dropped":                 "over the count limit",
+		}
+	})
+
+	tgt, entryHandler, _ := newTestTargetWithClient(t, d.Client(), "flog", Options{
+		LabelsAsMetadata:       true,
+		MetadataMaxLabels:      2,
+		MetadataMaxValueLength: 2,
+	})
+	tgt.StartIfNotRunning()
+	defer tgt.Stop()
+
+	require.Eventually(t, func() bool {
+		return len(entryHandler.Received()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	entry := entryHandler.Received()[0]
+	require.Equal(t, push.LabelsAdapter{
+		{Name: "com_docker_compose_project", Value: "sh"},
+		// The value is truncated without splitting the two bytes of "ä".
+		{Name: "description", Value: "k"},
+	}, entry.StructuredMetadata)
+	require.Equal(t, model.LabelSet{"job": "docker"}, entry.Labels)
+}
+
+func TestDockerTargetLineTruncated(t *testing.T) {
+	// Long messages are split by the logging driver, and each part gets its
+	// own timestamp when read back.
+	split := "2023-12-09T09:16:57.000000000Z " + strings.Repeat("a", partialMessageSize) + "2023-12-09T09:16:57.000000001Z rest"
+
+	d := fakedocker.New(t)
+	d.AddContainer("flog", "/flog",
+		"2023-12-09T09:16:56.000000000Z short",
+		split,
+		"2023-12-09T09:16:58.000000000Z cut off [...]",
+	)
+
+	for _, keep := range []bool{false, true} {
+		t.Run(fmt.Sprintf("keep timestamp prefix %t", keep), func(t *testing.T) {
+			rcs := []*relabel.Config{labelMapRule(dockerLabelLineTruncated, "truncated")}
+			tgt, entryHandler, _ := newTestTargetWithRelabel(t, d.Client(), "flog", rcs, Options{
+				TruncationMarker:    "[...]",
+				KeepTimestampPrefix: keep,
+			})
+			tgt.StartIfNotRunning()
+			defer tgt.Stop()
+
+			require.Eventually(t, func() bool {
+				return len(entryHandler.Received()) == 3
+			}, 5*time.Second, 10*time.Millisecond)
+			received := entryHandler.Received()
+			require.NotContains(t, received[0].Labels, model.LabelName("truncated"))
+			require.Equal(t, model.LabelValue("true"), received[1].Labels["truncated"])
+			require.Equal(t, model.LabelValue("true"), received[2].Labels["truncated"])
+			if keep {
+				require.Equal(t, split, received[1].Line)
+			}
+		})
+	}
+}
+
+func TestDockerTargetDebugWriter(t *testing.T) {
+	d := fakedocker.New(t)
+	d.AddContainer("flog", "/flog",
+		"2023-12-09T09:16:57.000000000Z first",
+		"2023-12-09T09:16:58.000000000Z \"quoted\" second",
+	)
+
+	var buf bytes.Buffer
+	tgt, entryHandler, _ := newTestTargetWithClient(t, d.Client(), "flog", Options{DebugWriter: &buf})
+	tgt.StartIfNotRunning()
+	require.Eventually(t, func() bool {
+		return len(entryHandler.Received()) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	tgt.Stop()
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	require.Len(t, lines, 2)
+	for i, line := range lines {
+		var got struct {
+			Labels    model.LabelSet `json:"labels"`
+			Timestamp time.Time      `json:"timestamp"`
+			Line      string         `json:"line"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(line), &got))
+
+		want := entryHandler.Received()[i]
+		require.Equal(t, want.Labels, got.Labels)
+		require.True(t, want.Timestamp.Equal(got.Timestamp))
+		require.Equal(t, want.Line, got.Line)
+	}
+	require.Equal(t, `"quoted" second`, entryHandler.Received()[1].Line)
+}
+
+func TestDockerTargetSharedDebugWriter(t *testing.T) {
+	const lines = 200
+	d := fakedocker.New(t)
+	var buf bytes.Buffer
+	var (
+		targets  []*Target
+		handlers []*fake.Client
+	)
+	for _, id := range []string{"a", "b"} {
+		fixture := make([]string, lines)
+		for i := range fixture {
+			fixture[i] = fmt.Sprintf("2023-12-09T09:16:57.%09dZ %s %d %s", i, id, i, strings.Repeat("x", 512))
+		}
+		d.AddContainer(id, "/"+id, fixture...)
+
+		tgt, entryHandler, _ := newTestTargetWithClient(t, d.Client(), id, Options{DebugWriter: &buf})
+		tgt.StartIfNotRunning()
+		targets = append(targets, tgt)
+		handlers = append(handlers, entryHandler)
+	}
+	require.Eventually(t, func() bool {
+		return len(handlers[0].Received()) == lines && len(handlers[1].Received()) == lines
+	}, 5*time.Second, 10*time.Millisecond)
+	for _, tgt := range targets {
+		tgt.Stop()
+	}
+
+	// Writes of the targets don't interleave.
+	require.Same(t, debugWriterLock(&buf), debugWriterLock(&buf))
+	out := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	require.Len(t, out, 2*lines)
+	for _, line := range out {
+		var got map[string]any
+		require.NoError(t, json.Unmarshal([]byte(line), &got), line)
+	}
+}
+
+func TestDockerTargetTimestampSources(t *testing.T) {
+	d := fakedocker.New(t)
+	d.AddContainer("flog", "/flog",
+		"2023-12-09T09:16:57.000000000Z 2023-01-01T00:00:00Z inline",
+		"2023-12-09T09:16:58.000000000Z docker",
+		"ingest",
+	)
+
+	opts := Options{
+		TimestampSources: []TimestampSource{TimestampSourceInline, TimestampSourceDocker, TimestampSourceIngest},
+	}
+	tgt, entryHandler, _ := newTestTargetWithClient(t, d.Client(), "flog", opts)
+	start := time.Now()
+	tgt.StartIfNotRunning()
+	defer tgt.Stop()
+
+	require.Eventually(t, func() bool {
+		return len(entryHandler.Received()) == 3
+	}, 5*time.Second, 10*time.Millisecond)
+	received := entryHandler.Received()
+
+	require.Equal(t, "2023-01-01T00:00:00Z inline", received[0].Line)
+	require.Equal(t, time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC), received[0].Timestamp.UTC())
+	require.Equal(t, "docker", received[1].Line)
+	require.Equal(t, time.Date(2023, 12, 9, 9, 16, 58, 0, time.UTC), received[1].Timestamp.UTC())
+	require.Equal(t, "ingest", received[2].Line)
+	require.False(t, received[2].Timestamp.Before(start))
+}
+
+func TestDockerTargetTimestampSourcesResume(t *testing.T) {
+	// The inline timestamps are a day ahead of the Docker ones.
+	start := time.Date(2023, 12, 9, 9, 16, 57, 0, time.UTC)
+	line := func(i int) string {
+		ts := start.Add(time.Duration(i) * time.Second)
+		return ts.Format(time.RFC3339Nano) + " " + ts.Add(24*time.Hour).Format(time.RFC3339Nano) + " line " + strconv.Itoa(i)
+	}
+
+	for _, src := range []TimestampSource{TimestampSourceInline, TimestampSourceIngest} {
+		t.Run(string(src), func(t *testing.T) {
+			d := fakedocker.New(t)
+			d.AddContainer("flog", "/flog", line(0), line(1))
+
+			tgt, entryHandler, ps := newTestTargetWithClient(t, d.Client(), "flog", Options{
+				TimestampSources: []TimestampSource{src},
+			})
+			tgt.StartIfNotRunning()
+			require.Eventually(t, func() bool {
+				return len(entryHandler.Received()) == 2
+			}, 5*time.Second, 10*time.Millisecond)
+			tgt.Stop()
+
+			// The position is the Docker timestamp of the last entry rather
+			// than its resolved timestamp.
+			received := entryHandler.Received()
+			require.NotEqual(t, start.Add(time.Second), received[1].Timestamp.UTC())
+			pos, err := ps.Get(positions.CursorKey("flog"), `{job="docker"}`)
+			require.NoError(t, err)
+			require.Equal(t, start.Add(time.Second).Unix(), pos)
+
+			// The target resumes from the Docker timestamp, so the lines logged
+			// in the meantime are read.
+			d.AppendLines("flog", line(2))
+			tgt.StartIfNotRunning()
+			defer tgt.Stop()
+			require.Eventually(t, func() bool {
+				return len(entryHandler.Received()) == 3
+			}, 5*time.Second, 10*time.Millisecond)
+			require.Equal(t, line(2)[len(start.Format(time.RFC3339Nano))+1:], entryHandler.Received()[2].Line)
+		})
+	}
+}
+
+func TestNewTargetInvalidTimestampSources(t *testing.T) {
+	for _, opts := range []Options{
+		{TimestampSources: []TimestampSource{"journal"}},
+		{TimestampSources: []TimestampSource{TimestampSourceInline}, InlineTimestampExpression: `^\S+`},
+	} {
+		_, err := NewTarget(nil, nil, nil, nil, "flog", nil, nil, nil, opts)
+		require.Error(t, err)
+	}
+}
+
+func TestDockerTargetRequiredLabel(t *testing.T) {
+	d := fakedocker.New(t)
+	d.AddContainer("app", "/app", "2023-12-09T09:16:57Z ready")
+
+	opts := Options{
+		RequiredLabel:      "com.example.ready",
+		AttachPollInterval: 10 * time.Millisecond,
+	}
+	tgt, entryHandler, _ := newTestTargetWithClient(t, d.Client(), "app", opts)
+	tgt.StartIfNotRunning()
+	defer tgt.Stop()
+
+	require.Eventually(t, func() bool {
+		return tgt.Status() == StatusWaiting
+	}, 5*time.Second, 10*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	require.Zero(t, d.OpenStreams("app"))
+	require.Empty(t, entryHandler.Received())
+
+	// The label is set without emitting an event, so it must be picked up by
+	// polling.
+	d.UpdateInfo("app", func(info *types.ContainerJSON) {
+		info.Config.Labels = map[string]string{"com.example.ready": "true"}
+	})
+	require.Eventually(t, func() bool {
+		return len(entryHandler.Received()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, "ready", entryHandler.Received()[0].Line)
+}
+
+func TestDockerTargetRequiredLabelTimeout(t *testing.T) {
+	d := fakedocker.New(t)
+	d.AddContainer("app", "/app", "2023-12-09T09:16:57Z never read")
+
+	opts := Options{
+		RequiredLabel:        "com.example.ready",
+		RequiredLabelTimeout: 50 * time.Millisecond,
+		AttachPollInterval:   10 * time.Millisecond,
+	}
+	tgt, entryHandler, _ := newTestTargetWithClient(t, d.Client(), "app", opts)
+	tgt.StartIfNotRunning()
+	defer tgt.Stop()
+
+	require.Eventually(t, func() bool {
+		return !tgt.Ready()
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Contains(t, tgt.Details()["error"], `required label "com.example.ready"`)
+	require.Empty(t, entryHandler.Received())
+}
+
+// labelMapRule returns a relabeling rule copying the value of the source
+// label to the target label, if it's set.
+func TestDockerTargetState(t *testing.T) {
+	d := fakedocker.New(t)
+	d.AddContainer("flog", "/flog",
+		"2023-12-09T09:16:50.000000000Z old",
+		"2023-12-09T09:16:57.100000000Z first",
+		"2023-12-09T09:16:57.200000000Z second",
+	)
+
+	prev, prevHandler, _ := newTestTargetWithClient(t, d.Client(), "flog", Options{})
+	prev.StartIfNotRunning()
+	require.Eventually(t, func() bool {
+		return len(prevHandler.Received()) == 3
+	}, 5*time.Second, 10*time.Millisecond)
+	prev.Reconnect()
+	prev.Stop()
+
+	// The state survives a round trip through its serialized form.
+	buf, err := json.Marshal(prev.ExportState())
+	require.NoError(t, err)
+	var state State
+	require.NoError(t, json.Unmarshal(buf, &state))
+
+	d.AppendLines("flog", "2023-12-09T09:16:58.000000000Z third")
+
+	// The new target has an empty positions file, and would read the whole
+	// log stream again without the restored state.
+	next, nextHandler, _ := newTestTargetWithClient(t, d.Client(), "flog", Options{})
+	require.NoError(t, next.RestoreState(state))
+	require.Equal(t, reconnectReasonManual, next.Details()["reconnect_reason"])
+	require.Len(t, next.RecentEntries(10), 3)
+
+	next.StartIfNotRunning()
+	defer next.Stop()
+	require.Error(t, next.RestoreState(state), "the state of a running target can't be restored")
+
+	require.Eventually(t, func() bool {
+		return len(nextHandler.Received()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Never(t, func() bool {
+		return len(nextHandler.Received()) > 1
+	}, 200*time.Millisecond, 10*time.Millisecond)
+	require.Equal(t, "third", nextHandler.Received()[0].Line)
+}
+
+func TestDockerTargetLabelTemplates(t *testing.T) {
+	const (
+		project = model.MetaLabelPrefix + "docker_container_label_com_docker_compose_project"
+		service = model.MetaLabelPrefix + "docker_container_label_com_docker_compose_service"
+	)
+	newTarget := func(templates map[string]string) *Target {
+		ps, err := positions.New(log.NewNopLogger(), positions.Config{
+			SyncPeriod:    10 * time.Second,
+			PositionsFile: t.TempDir() + "/positions.yml",
+		})
+		require.NoError(t, err)
+		t.Cleanup(ps.Stop)
+
+		tgt, err := NewTarget(
+			NewMetrics(prometheus.NewRegistry()),
+			log.NewNopLogger(),
+			fake.NewClient(func() {}),
+			ps,
+			"flog",
+			model.LabelSet{"job": "docker", project: "shop", service: "checkout"},
+			nil,
+			fakedocker.New(t).Client(),
+			Options{LabelTemplates: templates},
+		)
+		require.NoError(t, err)
+		return tgt
+	}
+
+	tgt := newTarget(map[string]string{
+		"job":     "{{ ." + project + " }}/{{ ." + service + " }}",
+		"missing": "{{ .__meta_docker_container_label_does_not_exist }}",
+		"stream":  "{{ .__meta_docker_container_log_stream | upper }}",
+	})
+	require.Equal(t, model.LabelSet{
+		"job":    "shop/checkout",
+		"stream": "STDERR",
+	}, tgt.getStreamLabels("stderr", nil))
+
+	// A template rendering to nothing keeps the original value.
+	tgt = newTarget(map[string]string{"job": "{{ .__meta_docker_container_label_does_not_exist }}"})
+	require.Equal(t, model.LabelSet{"job": "docker"}, tgt.getStreamLabels("stdout", nil))
+
+	_, err := NewTarget(nil, nil, nil, nil, "flog", nil, nil, nil, Options{LabelTemplates: map[string]string{"job": "{{ .unclosed"}})
+	require.Error(t, err)
+}
+
+func labelMapRule(source, target string) *relabel.Config {
+	return &relabel.Config{
+		SourceLabels: model.LabelNames{model.LabelName(source)},
+		Regex:        relabel.MustNewRegexp("(.+)"),
+		Action:       relabel.Replace,
+		Replacement:  "$1",
+		TargetLabel:  target,
+		Separator:    ";",
+	}
+}
+
+// newTestTarget creates a target for the "flog" container which talks to a
+// fake Docker daemon backed by h.
+func newTestTarget(t *testing.T, h http.HandlerFunc, opts Options) (*Target, *fake.Client, positions.Positions) {
+	t.Helper()
+
+	ts := httptest.NewServer(h)
+	t.Cleanup(ts.Close)
+
+	client, err := client.NewClientWithOpts(client.WithHost(ts.URL))
+	require.NoError(t, err)
+	return newTestTargetWithClient(t, client, "flog", opts)
+}
+
+// newTestTargetWithClient creates a target for the given container which uses
+// the given Docker client.
+func newTestTargetWithClient(t *testing.T, client client.APIClient, containerID string, opts Options) (*Target, *fake.Client, positions.Positions) {
+	t.Helper()
+	return newTestTargetWithRelabel(t, client, containerID, nil, opts)
+}
+
+// newTestTargetWithRelabel creates a target for the given container which
+// uses the given Docker client and relabeling rules.
+func newTestTargetWithRelabel(t *testing.T, client client.APIClient, containerID string, relabelConfig []*relabel.Config, opts Options) (*Target, *fake.Client, positions.Positions) {
+	t.Helper()
+
+	logger := log.NewLogfmtLogger(log.NewSyncWriter(os.Stderr))
+	entryHandler := fake.NewClient(func() {})
+
+	ps, err := positions.New(logger, positions.Config{
+		SyncPeriod:    10 * time.Second,
+		PositionsFile: t.TempDir() + "/positions.yml",
+	})
+	require.NoError(t, err)
+	t.Cleanup(ps.Stop)
+
+	tgt, err := NewTarget(
+		NewMetrics(prometheus.NewRegistry()),
+		logger,
+		entryHandler,
+		ps,
+		containerID,
+		model.LabelSet{"job": "docker"},
+		relabelConfig,
+		client,
+		opts,
+	)
+	require.NoError(t, err)
+	return tgt, entryHandler, ps
+}
+
+func writeContainerJSON(t *testing.T, w http.ResponseWriter, info types.ContainerJSON) {
+	t.Helper()
+
+	w.Header().Set("Content-Type", "application/json")
+	require.NoError(t, json.NewEncoder(w).Encode(info))
+}
@@ -0,0 +1,132 @@
+package dockertarget
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// TimestampSource is a source the timestamp of an entry is resolved from.
+type TimestampSource string
+
+const (
+	// TimestampSourceInline reads the timestamp from the content of the line,
+	// using Options.InlineTimestampExpression and Options.InlineTimestampLayout.
+	// The timestamp is kept in the line.
+	TimestampSourceInline TimestampSource = "inline"
+	// TimestampSourceDocker reads the timestamp Docker prefixes to every line.
+	TimestampSourceDocker TimestampSource = "docker"
+	// TimestampSourceIngest uses the time the line is read at. It always
+	// resolves.
+	TimestampSourceIngest TimestampSource = "ingest"
+)
+
+const (
+	// defaultInlineTimestampExpression matches the first word of a line if
+	// Options.InlineTimestampExpression is unset.
+	defaultInlineTimestampExpression = `^(\S+)`
+	// defaultInlineTimestampLayout is the layout of inline timestamps if
+	// Options.InlineTimestampLayout is unset.
+	defaultInlineTimestampLayout = time.RFC3339Nano
+)
+
+// defaultTimestampSources is used if Options.TimestampSources is empty. Lines
+// without a valid Docker timestamp are skipped.
+var defaultTimestampSources = []TimestampSource{TimestampSourceDocker}
+
+// timestampResolver resolves the timestamps of entries from an ordered list
+// of sources.
+type timestampResolver struct {
+	sources []TimestampSource
+	inline  *regexp.Regexp
+	layout  string
+}
+
+// newTimestampResolver validates the timestamp options and returns a
+// resolver for them.
+func newTimestampResolver(opts Options) (*timestampResolver, error) {
+	sources := opts.TimestampSources
+	if len(sources) == 0 {
+		sources = defaultTimestampSources
+	}
+
+	r := &timestampResolver{sources: sources, layout: opts.InlineTimestampLayout}
+	if r.layout == "" {
+		r.layout = defaultInlineTimestampLayout
+	}
+	for _, src := range sources {
+		switch src {
+		case TimestampSourceInline:
+			if r.inline != nil {
+				continue
+			}
+			expr := opts.InlineTimestampExpression
+			if expr == "" {
+				expr = defaultInlineTimestampExpression
+			}
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid inline timestamp expression %q: %w", expr, err)
+			}
+			if re.NumSubexp() < 1 {
+				return nil, fmt.Errorf("inline timestamp expression %q must have a capturing group", expr)
+			}
+			r.inline = re
+		case TimestampSourceDocker, TimestampSourceIngest:
+		default:
+			return nil, fmt.Errorf("unknown timestamp source %q", src)
+		}
+	}
+	return r, nil
+}
+
+// Resolve returns the timestamp of the first source which resolves for the
+// line, with its Docker timestamp prefix already stripped. dockerTs and
+// dockerErr are the result of reading the prefix.
+func (r *timestampResolver) Resolve(dockerTs time.Time, dockerErr error, line string) (time.Time, error) {
+	err := fmt.Errorf("no timestamp source resolved")
+	for _, src := range r.sources {
+		switch src {
+		case TimestampSourceInline:
+			ts, inlineErr := r.inlineTimestamp(line)
+			if inlineErr == nil {
+				return ts, nil
+			}
+			err = inlineErr
+		case TimestampSourceDocker:
+			if dockerErr == nil {
+				return dockerTs, nil
+			}
+			err = dockerErr
+		case TimestampSourceIngest:
+			return time.Now(), nil
+		}
+	}
+	return time.Time{}, err
+}
+
+func (r *timestampResolver) inlineTimestamp(line string) (time.Time, error) {
+	m := r.inline.FindStringSubmatch(line)
+	if m == nil {
+		return time.Time{}, fmt.Errorf("could not find inline timestamp in '%s'", line)
+	}
+	ts, err := time.Parse(r.layout, m[1])
+	if err != nil {
+		return time.Time{}, fmt.Errorf("could not parse inline timestamp from '%s': %w", m[1], err)
+	}
+	return ts, nil
+}
+
+// lineStamp holds the timestamps of a line. ts is the timestamp of its
+// entry, resolved from Options.TimestampSources, while docker is the
+// timestamp Docker recorded the line at, or zero if the line has none.
+// Positions, deduplication and the ingestion lag are always based on the
+// Docker timestamp, so that a timestamp taken from the line or at ingestion
+// doesn't decide where the log stream is resumed from.
+type lineStamp struct {
+	ts     time.Time
+	docker time.Time
+	// prefix is the timestamp prefix removed from the line, kept for
+	// Options.KeepTimestampPrefix.
+	prefix string
+}
@@ -0,0 +1,47 @@
+package dockertarget
+
+import (
+	"strings"
+	"time"
+)
+
+// dockerLabelLineTruncated is set on entries which were detected to be
+// truncated or split by the logging driver.
+const dockerLabelLineTruncated = dockerLabel + "line_truncated"
+
+// partialMessageSize is the size at which logging drivers split long log
+// messages into partial messages. When read with timestamps, the parts of a
+// split message are joined again, but the timestamp of each part is inserted
+// in between.
+const partialMessageSize = 16 * 1024
+
+// isTruncated reports whether the line of an entry was truncated or split by
+// the logging driver.
+func (t *Target) isTruncated(line string) bool {
+	if m := t.opts.TruncationMarker; m != "" && strings.HasSuffix(line, m) {
+		return true
+	}
+	return isPartial(line)
+}
+
+// isPartial reports whether line consists of partial messages, i.e. whether
+// a timestamp follows the first part.
+func isPartial(line string) bool {
+	if len(line) <= partialMessageSize {
+		return false
+	}
+	rest := line[partialMessageSize:]
+	// Timestamps are at most as long as the layout, which can't contain the
+	// separating space.
+	end := len(dockerTimestampLayout) + 1
+	if end > len(rest) {
+		end = len(rest)
+	}
+	for i := 0; i < end; i++ {
+		if rest[i] == ' ' {
+			_, err := time.Parse(dockerTimestampLayout, rest[:i])
+			return err == nil
+		}
+	}
+	return false
+}
@@ -0,0 +1,496 @@
+// Package fakedocker provides a fake Docker daemon for tests.
+package fakedocker
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/stretchr/testify/require"
+)
+
+// Daemon is a fake Docker daemon serving the logs, inspect information
+// and events of a set of containers. The log streams of the containers are
+// kept open, as they would be for running containers.
+type Daemon struct {
+	t   *testing.T
+	srv *httptest.Server
+
+	mut        sync.Mutex
+	containers map[string]*containerState
+	images     map[string]types.ImageInspect
+	userAgents map[string]struct{}
+
+	// eventsEnded is closed to end the event streams currently open.
+	eventsEnded   chan struct{}
+	eventRequests int
+	failEvents    int
+}
+
+type containerState struct {
+	info        types.ContainerJSON
+	lines       []string
+	stderrLines []string
+	events      chan events.Message
+	openStreams int
+
+	// stopped is closed once the container stops, which ends its log streams.
+	stopped  chan struct{}
+	attaches []time.Time
+	inspects int
+	// failInspects is the number of inspects to fail before succeeding.
+	failInspects int
+}
+
+// New returns a Daemon without containers, which is closed once the test
+// ends.
+func New(t *testing.T) *Daemon {
+	d := &Daemon{
+		t:           t,
+		containers:  make(map[string]*containerState),
+		images:      make(map[string]types.ImageInspect),
+		userAgents:  make(map[string]struct{}),
+		eventsEnded: make(chan struct{}),
+	}
+	d.srv = httptest.NewServer(http.HandlerFunc(d.serveHTTP))
+	t.Cleanup(d.srv.Close)
+	return d
+}
+
+// AddContainer adds a container with the given name which logs lines to
+// stdout.
+func (d *Daemon) AddContainer(id, name string, lines ...string) {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+
+	d.containers[id] = &containerState{
+		info: types.ContainerJSON{
+			ContainerJSONBase: &types.ContainerJSONBase{ID: id, Name: name},
+			Config:            &container.Config{},
+		},
+		lines:   lines,
+		events:  make(chan events.Message, 10),
+		stopped: make(chan struct{}),
+	}
+}
+
+// AddImage adds an image, whose inspect information is served under its ID.
+func (d *Daemon) AddImage(image types.ImageInspect) {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	d.images[image.ID] = image
+}
+
+// AppendLines adds lines to the logs of a container. They are only sent to
+// log streams opened afterwards.
+func (d *Daemon) AppendLines(id string, lines ...string) {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+
+	c := d.containers[id]
+	c.lines = append(c.lines, lines...)
+}
+
+// AppendStderrLines adds lines to the stderr logs of a container. They are
+// sent after the stdout lines.
+func (d *Daemon) AppendStderrLines(id string, lines ...string) {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+
+	c := d.containers[id]
+	c.stderrLines = append(c.stderrLines, lines...)
+}
+
+// UpdateInfo updates the inspect information of a container.
+func (d *Daemon) UpdateInfo(id string, f func(info *types.ContainerJSON)) {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	f(&d.containers[id].info)
+}
+
+// Rename renames a container and emits the corresponding event.
+func (d *Daemon) Rename(id, name string) {
+	d.mut.Lock()
+	c := d.containers[id]
+	c.info.Name = name
+	d.mut.Unlock()
+
+	c.events <- events.Message{
+		Type:   events.ContainerEventType,
+		Action: "rename",
+		Actor:  events.Actor{ID: id, Attributes: map[string]string{"name": strings.TrimPrefix(name, "/")}},
+	}
+}
+
+// SetHealth sets the health status of a container and emits the
+// corresponding event.
+func (d *Daemon) SetHealth(id, status string) {
+	d.mut.Lock()
+	c := d.containers[id]
+	if c.info.State == nil {
+		c.info.State = &types.ContainerState{Running: true}
+	}
+	c.info.State.Health = &types.Health{Status: status}
+	d.mut.Unlock()
+
+	now := time.Now()
+	c.events <- events.Message{
+		Type:     events.ContainerEventType,
+		Action:   "health_status: " + status,
+		Actor:    events.Actor{ID: id},
+		Time:     now.Unix(),
+		TimeNano: now.UnixNano(),
+	}
+}
+
+// SetPaused pauses or unpauses a container and emits the corresponding
+// event. Its log streams stay open.
+func (d *Daemon) SetPaused(id string, paused bool) {
+	d.mut.Lock()
+	c := d.containers[id]
+	if c.info.State == nil {
+		c.info.State = &types.ContainerState{Running: true}
+	}
+	c.info.State.Paused = paused
+	d.mut.Unlock()
+
+	action := "unpause"
+	if paused {
+		action = "pause"
+	}
+	c.events <- events.Message{
+		Type:   events.ContainerEventType,
+		Action: action,
+		Actor:  events.Actor{ID: id},
+	}
+}
+
+// EndStreams ends the current log streams of a container without changing
+// its state, e.g. as if the connection to the daemon was lost.
+func (d *Daemon) EndStreams(id string) {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	c := d.containers[id]
+	close(c.stopped)
+	c.stopped = make(chan struct{})
+}
+
+// Restart restarts a container, which ends its current log streams, and
+// emits the corresponding event.
+func (d *Daemon) Restart(id string, startedAt time.Time) {
+	d.mut.Lock()
+	c := d.containers[id]
+	close(c.stopped)
+	c.stopped = make(chan struct{})
+	c.info.State = &types.ContainerState{Running: true, StartedAt: startedAt.Format(time.RFC3339Nano)}
+	d.mut.Unlock()
+
+	c.events <- events.Message{
+		Type:   events.ContainerEventType,
+		Action: "start",
+		Actor:  events.Actor{ID: id},
+	}
+}
+
+// Attaches returns the times log streams were opened for a container.
+func (d *Daemon) Attaches(id string) []time.Time {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	return append([]time.Time(nil), d.containers[id].attaches...)
+}
+
+// Inspects returns the number of times a container was inspected.
+func (d *Daemon) Inspects(id string) int {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	return d.containers[id].inspects
+}
+
+// FailInspects fails the next n inspects of a container with a server
+// error.
+func (d *Daemon) FailInspects(id string, n int) {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	d.containers[id].failInspects = n
+}
+
+// OpenStreams returns the number of log streams currently open for a
+// container.
+func (d *Daemon) OpenStreams(id string) int {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	return d.containers[id].openStreams
+}
+
+// FailEvents ends the event streams currently open, and fails the next n
+// requests for events, as if the connection to the daemon was lost.
+func (d *Daemon) FailEvents(n int) {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	close(d.eventsEnded)
+	d.eventsEnded = make(chan struct{})
+	d.failEvents = n
+}
+
+// EventRequests returns the number of requests for events, including failed
+// ones.
+func (d *Daemon) EventRequests() int {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	return d.eventRequests
+}
+
+// URL returns the address of the Daemon.
+func (d *Daemon) URL() string {
+	return d.srv.URL
+}
+
+// SeenUserAgent reports whether every request was sent with the given
+// User-Agent.
+func (d *Daemon) SeenUserAgent(ua string) bool {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	_, ok := d.userAgents[ua]
+	return ok && len(d.userAgents) == 1
+}
+
+// Client returns a client of the Daemon.
+func (d *Daemon) Client() client.APIClient {
+	c, err := client.NewClientWithOpts(client.WithHost(d.srv.URL))
+	require.NoError(d.t, err)
+	return c
+}
+
+func (d *Daemon) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	d.mut.Lock()
+	d.userAgents[r.UserAgent()] = struct{}{}
+	d.mut.Unlock()
+
+	path := r.URL.Path
+	if strings.HasSuffix(path, "/_ping") {
+		w.Header().Set("API-Version", "1.43")
+		return
+	}
+	if strings.HasSuffix(path, "/events") {
+		args, err := filters.FromJSON(r.URL.Query().Get("filters"))
+		require.NoError(d.t, err)
+		var ids []string
+		if args.Contains("container") {
+			ids = args.Get("container")
+		}
+		d.serveEvents(w, r, ids)
+		return
+	}
+
+	// Paths are of the form /<version>/<containers|images>/<id>/<endpoint>.
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	require.GreaterOrEqual(d.t, len(parts), 3)
+	id, endpoint := parts[len(parts)-2], parts[len(parts)-1]
+	if parts[len(parts)-3] == "images" {
+		d.serveImage(w, id)
+		return
+	}
+
+	// The inspect information is encoded while holding the lock, since it
+	// may be updated concurrently.
+	d.mut.Lock()
+	c, ok := d.containers[id]
+	var (
+		info        []byte
+		lines       []string
+		stderrLines []string
+		stopped     chan struct{}
+	)
+	if ok {
+		var err error
+		info, err = json.Marshal(c.info)
+		require.NoError(d.t, err)
+		lines = append(lines, c.lines...)
+		stderrLines = append(stderrLines, c.stderrLines...)
+		stopped = c.stopped
+	}
+	d.mut.Unlock()
+	if !ok {
+		http.Error(w, "no such container", http.StatusNotFound)
+		return
+	}
+
+	switch endpoint {
+	case "wait":
+		// Respond once the container stops.
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+		case <-stopped:
+			require.NoError(d.t, json.NewEncoder(w).Encode(container.WaitResponse{}))
+		}
+	case "logs":
+		d.mut.Lock()
+		c.openStreams++
+		c.attaches = append(c.attaches, time.Now())
+		d.mut.Unlock()
+		defer func() {
+			d.mut.Lock()
+			c.openStreams--
+			d.mut.Unlock()
+		}()
+
+		// Honor the since parameter with the resolution of seconds used by
+		// Docker.
+		since, err := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+		require.NoError(d.t, err)
+		// Old Docker versions ignore since when tail is set, so they must
+		// never be combined.
+		if tail := r.URL.Query().Get("tail"); tail != "" && tail != "all" {
+			require.Zero(d.t, since, "since and tail are both set")
+			n, err := strconv.Atoi(tail)
+			require.NoError(d.t, err)
+			if n < len(lines) {
+				lines = lines[len(lines)-n:]
+			}
+		}
+		// Writes fail once the client closed the log stream, which it may do
+		// at any time.
+		for _, line := range lines {
+			if ts, err := lineTimestamp(line); err != nil || ts.Unix() >= since {
+				if writeMuxedLines(w, stdcopy.Stdout, line) != nil {
+					return
+				}
+			}
+		}
+		for _, line := range stderrLines {
+			if ts, err := lineTimestamp(line); err != nil || ts.Unix() >= since {
+				if writeMuxedLines(w, stdcopy.Stderr, line) != nil {
+					return
+				}
+			}
+		}
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+		case <-stopped:
+		}
+	default:
+		d.mut.Lock()
+		c.inspects++
+		fail := c.failInspects > 0
+		if fail {
+			c.failInspects--
+		}
+		d.mut.Unlock()
+		if fail {
+			http.Error(w, "container is starting", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, err := w.Write(info)
+		require.NoError(d.t, err)
+	}
+}
+
+func (d *Daemon) serveImage(w http.ResponseWriter, id string) {
+	d.mut.Lock()
+	image, ok := d.images[id]
+	d.mut.Unlock()
+	if !ok {
+		http.Error(w, "no such image", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	require.NoError(d.t, json.NewEncoder(w).Encode(image))
+}
+
+func (d *Daemon) serveEvents(w http.ResponseWriter, r *http.Request, ids []string) {
+	d.mut.Lock()
+	d.eventRequests++
+	if d.failEvents > 0 {
+		d.failEvents--
+		d.mut.Unlock()
+		http.Error(w, "events unavailable", http.StatusInternalServerError)
+		return
+	}
+	ended := d.eventsEnded
+	d.mut.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+
+	d.mut.Lock()
+	var chans []chan events.Message
+	for _, id := range ids {
+		if c, ok := d.containers[id]; ok {
+			chans = append(chans, c.events)
+		}
+	}
+	d.mut.Unlock()
+
+	// Fan in the events of all requested containers.
+	msgs := make(chan events.Message)
+	for _, ch := range chans {
+		go func(ch chan events.Message) {
+			for {
+				select {
+				case <-r.Context().Done():
+					return
+				case msg := <-ch:
+					select {
+					case msgs <- msg:
+					case <-r.Context().Done():
+						return
+					}
+				}
+			}
+		}(ch)
+	}
+
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ended:
+			return
+		case msg := <-msgs:
+			require.NoError(d.t, enc.Encode(msg))
+			w.(http.Flusher).Flush()
+		}
+	}
+}
+
+// lineTimestamp returns the timestamp Docker prefixes a line with.
+func lineTimestamp(line string) (time.Time, error) {
+	ts, _, _ := strings.Cut(line, " ")
+	return time.Parse(time.RFC3339Nano, ts)
+}
+
+// WriteMuxedLines writes lines to w using the multiplexed stream format of
+// the Docker API.
+func WriteMuxedLines(t *testing.T, w io.Writer, stream stdcopy.StdType, lines ...string) {
+	t.Helper()
+
+	require.NoError(t, writeMuxedLines(w, stream, lines...))
+}
+
+func writeMuxedLines(w io.Writer, stream stdcopy.StdType, lines ...string) error {
+	sw := stdcopy.NewStdWriter(w, stream)
+	for _, line := range lines {
+		if _, err := sw.Write([]byte(line + "\n")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
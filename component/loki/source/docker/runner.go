@@ -20,9 +20,10 @@ import (
 type manager struct {
 	log log.Logger
 
-	mut   sync.Mutex
-	opts  *options
-	tasks []*tailerTask
+	mut    sync.Mutex
+	opts   *options
+	tasks  []*tailerTask
+	paused bool
 
 	runner *runner.Runner[*tailerTask]
 }
@@ -121,9 +122,30 @@ func (m *manager) syncTargets(ctx context.Context, targets []*dt.Target) error {
 	m.mut.Lock()
 	defer m.mut.Unlock()
 
+	// Targets which replace the target of the same container, e.g. because its
+	// labels changed, continue where the previous target is at. The previous
+	// target is still running at this point, so lines read in the meantime may
+	// be sent again by the new target.
+	previous := make(map[string]*dt.Target, len(m.tasks))
+	for _, task := range m.runner.Tasks() {
+		previous[task.target.Name()] = task.target
+	}
+	for _, target := range targets {
+		prev, ok := previous[target.Name()]
+		if !ok || prev.LabelsStr() == target.LabelsStr() {
+			continue
+		}
+		if err := target.RestoreState(prev.ExportState()); err != nil {
+			level.Warn(m.log).Log("msg", "could not restore the state of the previous target", "container", target.Name(), "err", err)
+		}
+	}
+
 	// Convert targets into tasks to give to the runner.
 	tasks := make([]*tailerTask, 0, len(targets))
 	for _, target := range targets {
+		if m.paused {
+			target.Pause()
+		}
 		tasks = append(tasks, &tailerTask{
 			options: m.opts,
 			target:  target,
@@ -159,7 +181,7 @@ func (m *manager) syncTargets(ctx context.Context, targets []*dt.Target) error {
 		// might write its position again during shutdown after we removed it.
 		if _, found := newEntries[ent]; !found {
 			level.Info(m.log).Log("msg", "removing entry from positions file", "path", ent.Path, "labels", ent.Labels)
-			m.opts.positions.Remove(ent.Path, ent.Labels)
+			task.target.RemovePosition()
 		}
 	}
 
@@ -214,6 +236,29 @@ func (m *manager) updateOptions(ctx context.Context, newOptions *options) error
 	return nil
 }
 
+// pauseAll pauses all targets until resumeAll is called. Targets synchronized
+// in the meantime start out paused.
+func (m *manager) pauseAll() {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	m.paused = true
+	for _, task := range m.runner.Tasks() {
+		task.target.Pause()
+	}
+}
+
+// resumeAll resumes all targets paused by pauseAll.
+func (m *manager) resumeAll() {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	m.paused = false
+	for _, task := range m.runner.Tasks() {
+		task.target.Resume()
+	}
+}
+
 // targets returns the set of targets which are actively being tailed. targets
 // for tailers which have terminated are not included. The returned set of
 // targets are deduplicated.
@@ -52,14 +52,17 @@ func (s *ScrapeConfigBuilder) AppendDockerPipeline() {
 }
 
 func toLokiSourceDocker(sd *moby.DockerSDConfig, forwardTo []loki.LogsReceiver) *loki_docker.Arguments {
+	defaults := loki_docker.GetDefaultArguments()
 	return &loki_docker.Arguments{
-		Host:             sd.Host,
-		Targets:          nil,
-		ForwardTo:        forwardTo,
-		Labels:           nil,
-		RelabelRules:     flow_relabel.Rules{},
-		HTTPClientConfig: common.ToHttpClientConfig(&sd.HTTPClientConfig),
-		RefreshInterval:  time.Duration(sd.RefreshInterval),
+		Host:               sd.Host,
+		Targets:            nil,
+		ForwardTo:          forwardTo,
+		Labels:             nil,
+		RelabelRules:       flow_relabel.Rules{},
+		HTTPClientConfig:   common.ToHttpClientConfig(&sd.HTTPClientConfig),
+		RefreshInterval:    time.Duration(sd.RefreshInterval),
+		ReconnectRateLimit: defaults.ReconnectRateLimit,
+		ReconnectBurst:     defaults.ReconnectBurst,
 	}
 }
 